@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"flag"
 	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
@@ -57,6 +58,7 @@ func MultipleHash(filename string) (map[string]string, error) {
 		{Hasher: sha256.New(), Name: "sha256"},
 		{Hasher: sha512.New(), Name: "sha512"},
 		{Hasher: quickxorhash.New(), Name: "quickxorhash"},
+		{Hasher: crc32.NewIEEE(), Name: "crc32"},
 	}
 	var writers []io.Writer
 	for _, c := range configs {
@@ -0,0 +1,72 @@
+package aliyunpanapi
+
+import (
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const DefaultApiUrl = "https://api.aliyundrive.com"
+
+// WebClient calls the endpoints of the Aliyunpan web api that
+// tickstep/aliyunpan-api doesn't cover.
+type WebClient struct {
+	HttpClient resty.Client
+	BaseUrl    string
+
+	// lock guards token, a renewal replaces it while requests are sent.
+	lock  sync.RWMutex
+	token string
+}
+
+func NewWebClient(baseUrl string) *WebClient {
+	if len(baseUrl) == 0 {
+		baseUrl = DefaultApiUrl
+	}
+	client := &WebClient{BaseUrl: baseUrl}
+	client.HttpClient = *resty.New()
+	client.HttpClient.SetBaseURL(baseUrl)
+	client.HttpClient.SetHeaders(map[string]string{
+		"Referer":    "https://www.aliyundrive.com/",
+		"Origin":     "https://www.aliyundrive.com",
+		"User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36",
+	})
+	return client
+}
+
+func (p *WebClient) SetToken(accessToken string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.token = accessToken
+}
+
+func (p *WebClient) AccessToken() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.token
+}
+
+// post sends body as json to path and decodes the response into result.
+func (p *WebClient) post(path string, headers map[string]string, body interface{}, result interface{}) *ApiError {
+	return post(&p.HttpClient, p.AccessToken(), path, headers, body, result)
+}
+
+func post(client *resty.Client, token string, path string, headers map[string]string, body interface{}, result interface{}) *ApiError {
+	errRsp := &ErrorRsp{}
+	req := client.R().
+		SetHeaders(headers).
+		SetBody(body).
+		SetResult(result).
+		SetError(errRsp)
+	if len(token) != 0 {
+		req.SetAuthToken(token)
+	}
+	rsp, err := req.Post(path)
+	if err != nil {
+		return NewApiError(0, TransportError, err.Error())
+	}
+	if rsp.IsError() {
+		return ParseError(rsp.StatusCode(), errRsp)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package aliyunpanapi
+
+import (
+	"net/http"
+	"strings"
+)
+
+type (
+	// ErrorRsp is the error body of the Aliyunpan web api.
+	ErrorRsp struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+)
+
+type ApiError struct {
+	Code       string
+	Message    string
+	StatusCode int
+}
+
+const (
+	UnknownError       = "UnknownError"
+	TransportError     = "TransportError"
+	AccessTokenInvalid = "AccessTokenInvalid"
+	NotFound           = "NotFound"
+)
+
+func (p ApiError) Error() string {
+	return p.Code + ": " + p.Message
+}
+
+func NewApiError(statusCode int, code string, message string) *ApiError {
+	return &ApiError{code, message, statusCode}
+}
+
+// ParseError maps the error codes of the web api and the open platform to
+// the codes above, NotFound.File becomes NotFound for example.
+func ParseError(statusCode int, e *ErrorRsp) *ApiError {
+	code := e.Code
+	switch {
+	case strings.HasPrefix(code, NotFound):
+		code = NotFound
+	case code == "AccessTokenExpired":
+		code = AccessTokenInvalid
+	case len(code) != 0:
+	case statusCode == http.StatusUnauthorized:
+		code = AccessTokenInvalid
+	case statusCode == http.StatusNotFound:
+		code = NotFound
+	default:
+		code = UnknownError
+	}
+	return NewApiError(statusCode, code, e.Message)
+}
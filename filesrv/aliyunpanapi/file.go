@@ -0,0 +1,27 @@
+package aliyunpanapi
+
+type (
+	// File is a file or folder as listed by the share and open platform apis.
+	File struct {
+		DriveId         string `json:"drive_id"`
+		FileId          string `json:"file_id"`
+		Name            string `json:"name"`
+		Type            string `json:"type"`
+		ParentFileId    string `json:"parent_file_id"`
+		Size            int64  `json:"size"`
+		ContentHash     string `json:"content_hash"`
+		ContentHashName string `json:"content_hash_name"`
+		UpdatedAt       string `json:"updated_at"`
+	}
+
+	listFilesRsp struct {
+		Items      []File `json:"items"`
+		NextMarker string `json:"next_marker"`
+	}
+)
+
+const listPageSize = 100
+
+func (p *File) IsFolder() bool {
+	return p.Type == "folder"
+}
@@ -0,0 +1,161 @@
+package aliyunpanapi
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	DefaultOpenApiUrl = "https://openapi.alipan.com"
+	// OpenApiScope is enough to list the drives and download their files.
+	OpenApiScope = "user:base,file:all:read"
+)
+
+type (
+	// OpenClient calls the official Aliyunpan open platform, authorized by
+	// the OAuth flow of a registered application.
+	OpenClient struct {
+		HttpClient   resty.Client
+		BaseUrl      string
+		ClientId     string
+		ClientSecret string
+
+		// lock guards token, a renewal replaces it while requests are
+		// sent.
+		lock  sync.RWMutex
+		token string
+	}
+
+	OpenToken struct {
+		TokenType    string `json:"token_type"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+
+	openDownloadUrlRsp struct {
+		Url        string `json:"url"`
+		Expiration string `json:"expiration"`
+	}
+)
+
+func NewOpenClient(baseUrl string, clientId string, clientSecret string) *OpenClient {
+	if len(baseUrl) == 0 {
+		baseUrl = DefaultOpenApiUrl
+	}
+	client := &OpenClient{
+		BaseUrl:      baseUrl,
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+	}
+	client.HttpClient = *resty.New()
+	client.HttpClient.SetBaseURL(baseUrl)
+	return client
+}
+
+// AuthorizeUrl is the page where the owner of the drive grants access, it
+// redirects to redirectUri with the authorization code.
+func (p *OpenClient) AuthorizeUrl(redirectUri string) string {
+	return p.BaseUrl + "/oauth/authorize?" + url.Values{
+		"client_id":     {p.ClientId},
+		"redirect_uri":  {redirectUri},
+		"scope":         {OpenApiScope},
+		"response_type": {"code"},
+	}.Encode()
+}
+
+func (p *OpenClient) GetTokenByCode(code string) (*OpenToken, *ApiError) {
+	return p.requestToken(map[string]string{
+		"client_id":     p.ClientId,
+		"client_secret": p.ClientSecret,
+		"grant_type":    "authorization_code",
+		"code":          code,
+	})
+}
+
+func (p *OpenClient) GetTokenByRefreshToken(refreshToken string) (*OpenToken, *ApiError) {
+	return p.requestToken(map[string]string{
+		"client_id":     p.ClientId,
+		"client_secret": p.ClientSecret,
+		"grant_type":    "refresh_token",
+		"refresh_token": refreshToken,
+	})
+}
+
+func (p *OpenClient) requestToken(body map[string]string) (*OpenToken, *ApiError) {
+	token := &OpenToken{}
+	if err := post(&p.HttpClient, "", "/oauth/access_token", nil, body, token); err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	p.token = token.AccessToken
+	p.lock.Unlock()
+	return token, nil
+}
+
+func (p *OpenClient) AccessToken() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.token
+}
+
+func (p *OpenClient) GetDriveInfo() (*UserDrives, *ApiError) {
+	drives := &UserDrives{}
+	if err := post(&p.HttpClient, p.AccessToken(), "/adrive/v1.0/user/getDriveInfo", nil, map[string]string{}, drives); err != nil {
+		return nil, err
+	}
+	if len(drives.BackupDriveId) == 0 {
+		drives.BackupDriveId = drives.DefaultDriveId
+	}
+	return drives, nil
+}
+
+// ListFiles returns the direct children of a folder, root being the top
+// folder of the drive.
+func (p *OpenClient) ListFiles(driveId string, parentFileId string) ([]File, *ApiError) {
+	res := []File{}
+	marker := ""
+	for {
+		page := &listFilesRsp{}
+		if err := post(&p.HttpClient, p.AccessToken(), "/adrive/v1.0/openFile/list", nil, map[string]interface{}{
+			"drive_id":        driveId,
+			"parent_file_id":  parentFileId,
+			"limit":           listPageSize,
+			"order_by":        "name",
+			"order_direction": "ASC",
+			"marker":          marker,
+		}, page); err != nil {
+			return nil, err
+		}
+		res = append(res, page.Items...)
+		if len(page.NextMarker) == 0 {
+			return res, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+func (p *OpenClient) GetFile(driveId string, fileId string) (*File, *ApiError) {
+	file := &File{}
+	if err := post(&p.HttpClient, p.AccessToken(), "/adrive/v1.0/openFile/get", nil, map[string]string{
+		"drive_id": driveId,
+		"file_id":  fileId,
+	}, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (p *OpenClient) GetDownloadUrl(driveId string, fileId string, expireSec int) (string, *ApiError) {
+	res := &openDownloadUrlRsp{}
+	if err := post(&p.HttpClient, p.AccessToken(), "/adrive/v1.0/openFile/getDownloadUrl", nil, map[string]interface{}{
+		"drive_id":   driveId,
+		"file_id":    fileId,
+		"expire_sec": expireSec,
+	}, res); err != nil {
+		return "", err
+	}
+	return res.Url, nil
+}
@@ -0,0 +1,118 @@
+package aliyunpanapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+)
+
+const PassportUrl = "https://passport.aliyundrive.com"
+
+type (
+	// QrCode is a pending login, CodeContent is the text to encode into the
+	// QR code scanned with the Aliyunpan app.
+	QrCode struct {
+		T           int64  `json:"t"`
+		Ck          string `json:"ck"`
+		CodeContent string `json:"codeContent"`
+	}
+
+	QrCodeStatus struct {
+		// Status is one of the QrCode* constants.
+		Status       string
+		RefreshToken string
+	}
+
+	passportRsp[T any] struct {
+		Content struct {
+			Data T `json:"data"`
+		} `json:"content"`
+		HasError bool `json:"hasError"`
+	}
+
+	queryQrCodeData struct {
+		QrCodeStatus string `json:"qrCodeStatus"`
+		BizExt       string `json:"bizExt"`
+	}
+
+	qrCodeBizExt struct {
+		PdsLoginResult struct {
+			RefreshToken string `json:"refreshToken"`
+		} `json:"pds_login_result"`
+	}
+)
+
+const (
+	QrCodeNew       = "NEW"
+	QrCodeScanned   = "SCANED"
+	QrCodeConfirmed = "CONFIRMED"
+	QrCodeExpired   = "EXPIRED"
+	QrCodeCanceled  = "CANCELED"
+)
+
+var passportParams = map[string]string{
+	"appName":     "aliyun_drive",
+	"fromSite":    "52",
+	"appEntrance": "web",
+	"isMobile":    "false",
+	"lang":        "zh_CN",
+	"returnUrl":   "",
+	"bizParams":   "",
+}
+
+// GenerateQrCode starts a QR code login on the passport site.
+func (p *WebClient) GenerateQrCode() (*QrCode, *ApiError) {
+	rsp := &passportRsp[QrCode]{}
+	res, err := p.HttpClient.R().
+		SetQueryParams(passportParams).
+		SetResult(rsp).
+		Get(PassportUrl + "/newlogin/qrcode/generate.do")
+	if err != nil {
+		return nil, NewApiError(0, TransportError, err.Error())
+	}
+	if res.IsError() || rsp.HasError || len(rsp.Content.Data.CodeContent) == 0 {
+		return nil, NewApiError(res.StatusCode(), UnknownError, res.String())
+	}
+	return &rsp.Content.Data, nil
+}
+
+// QueryQrCode returns the state of a QR code login, the refresh token is set
+// once the login was confirmed in the app.
+func (p *WebClient) QueryQrCode(code *QrCode) (*QrCodeStatus, *ApiError) {
+	form := map[string]string{
+		"t":  strconv.FormatInt(code.T, 10),
+		"ck": code.Ck,
+	}
+	for k, v := range passportParams {
+		form[k] = v
+	}
+	rsp := &passportRsp[queryQrCodeData]{}
+	res, err := p.HttpClient.R().
+		SetQueryParams(passportParams).
+		SetFormData(form).
+		SetResult(rsp).
+		Post(PassportUrl + "/newlogin/qrcode/query.do")
+	if err != nil {
+		return nil, NewApiError(0, TransportError, err.Error())
+	}
+	if res.IsError() || rsp.HasError {
+		return nil, NewApiError(res.StatusCode(), UnknownError, res.String())
+	}
+	status := &QrCodeStatus{Status: rsp.Content.Data.QrCodeStatus}
+	if status.Status != QrCodeConfirmed {
+		return status, nil
+	}
+	content, decodeErr := base64.StdEncoding.DecodeString(rsp.Content.Data.BizExt)
+	if decodeErr != nil {
+		return nil, NewApiError(res.StatusCode(), UnknownError, decodeErr.Error())
+	}
+	bizExt := &qrCodeBizExt{}
+	if err := json.Unmarshal(content, bizExt); err != nil {
+		return nil, NewApiError(res.StatusCode(), UnknownError, err.Error())
+	}
+	status.RefreshToken = bizExt.PdsLoginResult.RefreshToken
+	if len(status.RefreshToken) == 0 {
+		return nil, NewApiError(res.StatusCode(), UnknownError, "EmptyRefreshToken")
+	}
+	return status, nil
+}
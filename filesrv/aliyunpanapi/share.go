@@ -0,0 +1,80 @@
+package aliyunpanapi
+
+import "time"
+
+type (
+	ShareToken struct {
+		ShareToken string    `json:"share_token"`
+		ExpiresIn  int       `json:"expires_in"`
+		ExpireTime string    `json:"expire_time"`
+		ExpiresAt  time.Time `json:"-"`
+	}
+
+	ShareDownloadUrl struct {
+		DownloadUrl string `json:"download_url"`
+		Url         string `json:"url"`
+		Expiration  string `json:"expiration"`
+	}
+)
+
+// ShareLinkTokenInvalid is returned once the share token expired.
+const ShareLinkTokenInvalid = "ShareLinkTokenInvalid"
+
+// GetShareToken exchanges the id and password of a public share for the
+// token sent in the x-share-token header. No access token is needed.
+func (p *WebClient) GetShareToken(shareId string, sharePwd string) (*ShareToken, *ApiError) {
+	token := &ShareToken{}
+	if err := p.post("/v2/share_link/get_share_token", nil, map[string]string{
+		"share_id":  shareId,
+		"share_pwd": sharePwd,
+	}, token); err != nil {
+		return nil, err
+	}
+	token.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if t, err := time.Parse(time.RFC3339, token.ExpireTime); err == nil {
+		token.ExpiresAt = t
+	}
+	return token, nil
+}
+
+// ListShareFiles returns the direct children of a folder of the share, root
+// being the top folder.
+func (p *WebClient) ListShareFiles(shareToken string, shareId string, parentFileId string) ([]File, *ApiError) {
+	res := []File{}
+	marker := ""
+	for {
+		page := &listFilesRsp{}
+		if err := p.post("/adrive/v2/file/list_by_share", map[string]string{"X-Share-Token": shareToken}, map[string]interface{}{
+			"share_id":        shareId,
+			"parent_file_id":  parentFileId,
+			"limit":           listPageSize,
+			"order_by":        "name",
+			"order_direction": "ASC",
+			"marker":          marker,
+		}, page); err != nil {
+			return nil, err
+		}
+		res = append(res, page.Items...)
+		if len(page.NextMarker) == 0 {
+			return res, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+// GetShareDownloadUrl resolves the download url of a shared file, it needs
+// both the share token and the access token of a signed in account.
+func (p *WebClient) GetShareDownloadUrl(shareToken string, shareId string, fileId string, expireSec int) (*ShareDownloadUrl, *ApiError) {
+	res := &ShareDownloadUrl{}
+	if err := p.post("/v2/file/get_share_link_download_url", map[string]string{"X-Share-Token": shareToken}, map[string]interface{}{
+		"share_id":   shareId,
+		"file_id":    fileId,
+		"expire_sec": expireSec,
+	}, res); err != nil {
+		return nil, err
+	}
+	if len(res.DownloadUrl) == 0 {
+		res.DownloadUrl = res.Url
+	}
+	return res, nil
+}
@@ -0,0 +1,25 @@
+package aliyunpanapi
+
+type (
+	// UserDrives are the drives of an account. Older accounts only have the
+	// default drive, newer ones split it into a backup and a resource drive.
+	UserDrives struct {
+		DefaultDriveId  string `json:"default_drive_id"`
+		BackupDriveId   string `json:"backup_drive_id"`
+		ResourceDriveId string `json:"resource_drive_id"`
+		// AlbumDriveId isn't reported by the user apis, it is filled from
+		// the album api when known.
+		AlbumDriveId string `json:"-"`
+	}
+)
+
+func (p *WebClient) GetUserDrives() (*UserDrives, *ApiError) {
+	drives := &UserDrives{}
+	if err := p.post("/v2/user/get", nil, map[string]string{}, drives); err != nil {
+		return nil, err
+	}
+	if len(drives.BackupDriveId) == 0 {
+		drives.BackupDriveId = drives.DefaultDriveId
+	}
+	return drives, nil
+}
@@ -4,19 +4,60 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/state"
 )
 
 type AppContext struct {
-	ContextFile   string      `json:"contextFile"`
+	ContextFile string `json:"contextFile"`
+	// StateStore is the kind of store the state is kept in, json unless
+	// set. StatePath defaults to a path next to ContextFile, for a redis
+	// store it is the url of the server the replicas share.
+	StateStore    string      `json:"stateStore,omitempty"`
+	StatePath     string      `json:"statePath,omitempty"`
 	DefaultSource string      `json:"defaultSource"`
 	PlexHost      string      `json:"plexHost"`
 	LocalHash     string      `json:"localHash"`
 	Port          int32       `json:"port"`
-	Sources       interface{} `json:"sources"`
+	Sources       interface{} `json:"sources,omitempty"`
+
+	// RefreshIntervalSec is how often every source is refreshed, 6 hours
+	// unless set, a negative value turns scheduled refreshes off.
+	RefreshIntervalSec int `json:"refreshIntervalSec,omitempty"`
+	// AdminToken authorizes the admin endpoints, they are refused while it
+	// is empty. It is only read from the config file, never stored.
+	AdminToken string `json:"adminToken,omitempty"`
 }
 
+// Buckets of the state store. The app bucket holds the context without the
+// sources, the sources bucket the context of every source by name, the
+// items bucket the cached items of every source by name, and the refreshes
+// bucket the status of the last refresh of every source by name.
+const (
+	AppBucket       = "app"
+	SourcesBucket   = "sources"
+	ItemsBucket     = "items"
+	RefreshesBucket = "refreshes"
+
+	appKey = "context"
+)
+
 var App AppContext
 
+// State is the store the context was loaded from.
+var State state.Store
+
+// saveLock keeps concurrent saves from interleaving their writes, and
+// changes made through Update from racing with a save.
+var saveLock sync.Mutex
+
+// LoadContextFromConfigFile opens the state store selected by the config
+// file and loads the context from it. A new store is filled from the context
+// file of earlier versions when there is one, from the config file
+// otherwise.
 func LoadContextFromConfigFile(filename string) error {
 	var config AppContext
 
@@ -31,35 +72,194 @@ func LoadContextFromConfigFile(filename string) error {
 	if len(config.ContextFile) == 0 {
 		return errors.New("EmptyContextFilename")
 	}
-	if _, err := os.Stat(config.ContextFile); os.IsNotExist(err) {
-		App = config
-		return SaveContextToFile(config.ContextFile)
+	if len(config.StateStore) == 0 {
+		config.StateStore = state.StoreJson
 	}
-	return LoadContextFromContextFile(config.ContextFile)
+	if len(config.StatePath) == 0 {
+		config.StatePath = state.DefaultPath(config.StateStore, config.ContextFile)
+	}
+	store, err := state.Open(config.StateStore, config.StatePath)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Get(AppBucket, appKey); err == state.ErrNotFound {
+		initial, err := os.ReadFile(config.ContextFile)
+		if os.IsNotExist(err) {
+			initial = content
+		} else if err != nil {
+			store.Close()
+			return err
+		}
+		if err := importContext(store, initial); err != nil {
+			store.Close()
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"stateStore": config.StateStore,
+			"statePath":  config.StatePath,
+		}).Info("ContextImported")
+	} else if err != nil {
+		store.Close()
+		return err
+	}
+	if err := loadContext(store); err != nil {
+		store.Close()
+		return err
+	}
+	App.ContextFile = config.ContextFile
+	App.StateStore = config.StateStore
+	App.StatePath = config.StatePath
+	App.AdminToken = config.AdminToken
+	State = store
+	return nil
 }
 
-func LoadContextFromContextFile(filename string) error {
-	content, err := os.ReadFile(filename)
+// importContext splits a whole context document into the records of the
+// store. The app record is written last, it marks a complete import.
+func importContext(store state.Store, content []byte) error {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(content, &document); err != nil {
+		return err
+	}
+	var sources []struct {
+		Name    string                     `json:"name"`
+		Type    string                     `json:"type"`
+		Context map[string]json.RawMessage `json:"context"`
+	}
+	if raw, ok := document["sources"]; ok {
+		if err := json.Unmarshal(raw, &sources); err != nil {
+			return err
+		}
+	}
+	delete(document, "sources")
+	delete(document, "adminToken")
+
+	records := make(map[string][]byte)
+	items := make(map[string][]byte)
+	for _, s := range sources {
+		if raw, ok := s.Context["cachedItems"]; ok {
+			items[s.Name] = raw
+			delete(s.Context, "cachedItems")
+		}
+		record, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		records[s.Name] = record
+	}
+	app, err := json.MarshalIndent(document, "", "  ")
 	if err != nil {
 		return err
 	}
+	if err := store.Write(ItemsBucket, items); err != nil {
+		return err
+	}
+	if err := store.Write(SourcesBucket, records); err != nil {
+		return err
+	}
+	return store.Write(AppBucket, map[string][]byte{appKey: app})
+}
+
+// loadContext reads App from the store, the sources are ordered by name.
+func loadContext(store state.Store) error {
+	content, err := store.Get(AppBucket, appKey)
+	if err != nil {
+		return err
+	}
+	App = AppContext{}
 	if err := json.Unmarshal(content, &App); err != nil {
 		return err
 	}
+	records, err := store.List(SourcesBucket)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sources := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		var source interface{}
+		if err := json.Unmarshal(records[name], &source); err != nil {
+			return err
+		}
+		sources = append(sources, source)
+	}
+	App.Sources = sources
 	return nil
 }
 
-func SaveContextToFile(filename string) error {
-	content, err := json.MarshalIndent(App, "", "  ")
+// Update runs fn while no save is in progress. Goroutines that change the
+// context while it may be saved elsewhere make the change through it.
+func Update(fn func()) {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+	fn()
+}
+
+// SaveContext saves the app and the context of every source, the cached
+// items are saved by the sources when they change.
+func SaveContext() error {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+	if State == nil {
+		return errors.New("StateStoreNotOpen")
+	}
+	app := App
+	app.Sources = nil
+	app.AdminToken = ""
+	appContent, err := json.MarshalIndent(app, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filename, content, 0666)
+	records := make(map[string][]byte)
+	if App.Sources != nil {
+		content, err := json.Marshal(App.Sources)
+		if err != nil {
+			return err
+		}
+		var list []json.RawMessage
+		if err := json.Unmarshal(content, &list); err != nil {
+			return err
+		}
+		for _, raw := range list {
+			var record struct {
+				Name string `json:"name"`
+			}
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return err
+			}
+			records[record.Name] = raw
+		}
+	}
+	existing, err := State.List(SourcesBucket)
+	if err != nil {
+		return err
+	}
+	for name := range existing {
+		if _, ok := records[name]; !ok {
+			records[name] = nil
+		}
+	}
+	if err := State.Write(SourcesBucket, records); err != nil {
+		return err
+	}
+	return State.Write(AppBucket, map[string][]byte{appKey: appContent})
 }
 
-func SaveContext() error {
-	if len(App.ContextFile) == 0 {
-		return errors.New("EmptyContextFilename")
+// SaveSource saves the context of one source, record is the entry of the
+// source in App.Sources.
+func SaveSource(sourceName string, record interface{}) error {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+	if State == nil {
+		return errors.New("StateStoreNotOpen")
+	}
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
 	}
-	return SaveContextToFile(App.ContextFile)
+	return State.Write(SourcesBucket, map[string][]byte{sourceName: content})
 }
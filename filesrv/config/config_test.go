@@ -0,0 +1,78 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLegacyContextIsImportedOnce(t *testing.T) {
+	dir := t.TempDir()
+	contextFile := filepath.Join(dir, "context.json")
+	configFile := filepath.Join(dir, "config.json")
+	previous, previousState := App, State
+	t.Cleanup(func() { App, State = previous, previousState })
+
+	writeJson := func(filename string, document interface{}) {
+		content, err := json.Marshal(document)
+		if err != nil {
+			t.Fatalf("encode %s: %v", filename, err)
+		}
+		if err := os.WriteFile(filename, content, 0600); err != nil {
+			t.Fatalf("write %s: %v", filename, err)
+		}
+	}
+	legacy := func(itemId string) map[string]interface{} {
+		return map[string]interface{}{
+			"contextFile": contextFile,
+			"port":        8080,
+			"sources": []interface{}{map[string]interface{}{
+				"name": "drive",
+				"type": "S3",
+				"context": map[string]interface{}{
+					"bucket":      "bucket",
+					"cachedItems": []interface{}{map[string]interface{}{"itemId": itemId}},
+				},
+			}},
+		}
+	}
+	writeJson(configFile, map[string]interface{}{"contextFile": contextFile, "adminToken": "admin"})
+	writeJson(contextFile, legacy("object-1"))
+
+	if err := LoadContextFromConfigFile(configFile); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	items, err := State.Get(ItemsBucket, "drive")
+	if err != nil || string(items) != `[{"itemId":"object-1"}]` {
+		t.Errorf("imported items: got %s, %v", items, err)
+	}
+	record, err := State.Get(SourcesBucket, "drive")
+	if err != nil {
+		t.Fatalf("get source: %v", err)
+	}
+	var source struct {
+		Context map[string]json.RawMessage `json:"context"`
+	}
+	if err := json.Unmarshal(record, &source); err != nil {
+		t.Fatalf("decode source: %v", err)
+	}
+	if _, ok := source.Context["cachedItems"]; ok || string(source.Context["bucket"]) != `"bucket"` {
+		t.Errorf("imported source context: got %v", source.Context)
+	}
+	if sources, ok := App.Sources.([]interface{}); !ok || len(sources) != 1 || App.Port != 8080 || App.AdminToken != "admin" {
+		t.Errorf("loaded context: got %+v", App)
+	}
+	State.Close()
+
+	// The store is kept once imported, later changes of the file are
+	// ignored.
+	writeJson(contextFile, legacy("object-2"))
+	if err := LoadContextFromConfigFile(configFile); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	defer State.Close()
+	if items, err := State.Get(ItemsBucket, "drive"); err != nil || string(items) != `[{"itemId":"object-1"}]` {
+		t.Errorf("items after reload: got %s, %v", items, err)
+	}
+}
@@ -0,0 +1,189 @@
+package gdriveapi
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	DefaultBaseUrl  = "https://www.googleapis.com/drive/v3"
+	DefaultTokenUrl = "https://oauth2.googleapis.com/token"
+	ReadonlyScope   = "https://www.googleapis.com/auth/drive.readonly"
+)
+
+type (
+	// ServiceAccountKey is the JSON key file downloaded for a service account.
+	ServiceAccountKey struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyId string `json:"private_key_id"`
+		PrivateKey   string `json:"private_key"`
+		TokenUri     string `json:"token_uri"`
+	}
+
+	GetTokenRsp struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	DriveClient struct {
+		HttpClient resty.Client
+		BaseUrl    string
+		TokenUrl   string
+
+		// lock guards the token, which a renewal replaces while requests
+		// are sent with it.
+		lock      sync.RWMutex
+		token     string
+		expiresAt time.Time
+	}
+)
+
+func NewDriveClient(baseUrl string, tokenUrl string) *DriveClient {
+	client := &DriveClient{}
+	if len(baseUrl) == 0 {
+		baseUrl = DefaultBaseUrl
+	}
+	if len(tokenUrl) == 0 {
+		tokenUrl = DefaultTokenUrl
+	}
+	client.BaseUrl = baseUrl
+	client.TokenUrl = tokenUrl
+	client.HttpClient = *resty.New()
+	client.HttpClient.SetBaseURL(baseUrl)
+	return client
+}
+
+// GetTokenByRefreshToken exchanges the refresh token of an OAuth client for
+// an access token.
+func (p *DriveClient) GetTokenByRefreshToken(clientId string, clientSecret string, refreshToken string) (*GetTokenRsp, *ApiError) {
+	return p.requestToken(p.TokenUrl, map[string]string{
+		"client_id":     clientId,
+		"client_secret": clientSecret,
+		"refresh_token": refreshToken,
+		"grant_type":    "refresh_token",
+	})
+}
+
+// GetTokenByServiceAccount signs a JWT assertion with the key of a service
+// account. subject is the user to impersonate with domain-wide delegation
+// and may be empty.
+func (p *DriveClient) GetTokenByServiceAccount(key *ServiceAccountKey, scope string, subject string) (*GetTokenRsp, *ApiError) {
+	tokenUrl := p.TokenUrl
+	if len(key.TokenUri) != 0 && p.TokenUrl == DefaultTokenUrl {
+		tokenUrl = key.TokenUri
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": scope,
+		"aud":   tokenUrl,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	if len(subject) != 0 {
+		claims["sub"] = subject
+	}
+	assertion, err := signJwt(key, claims)
+	if err != nil {
+		return nil, NewApiError(InvalidCredentials, "InvalidServiceAccountKey", err.Error())
+	}
+	return p.requestToken(tokenUrl, map[string]string{
+		"grant_type": "urn:ietf:params:oauth:grant-type:jwt-bearer",
+		"assertion":  assertion,
+	})
+}
+
+func (p *DriveClient) requestToken(tokenUrl string, form map[string]string) (*GetTokenRsp, *ApiError) {
+	resp, err := p.HttpClient.
+		R().
+		SetResult(&GetTokenRsp{}).
+		SetError(&tokenErrorRsp{}).
+		SetFormData(form).
+		Post(tokenUrl)
+	if err != nil {
+		return nil, NewApiError(TransportError, "TransportError", err.Error())
+	}
+	if resp.IsError() {
+		e := resp.Error().(*tokenErrorRsp)
+		return nil, NewApiError(InvalidTokenRequest, e.Error, e.ErrorDescription)
+	}
+	token := resp.Result().(*GetTokenRsp)
+	p.SetToken(token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second))
+	return token, nil
+}
+
+func (p *DriveClient) SetToken(token string, expiresAt time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.token = token
+	p.expiresAt = expiresAt
+}
+
+// AccessToken returns the current access token, empty before the first one
+// was issued.
+func (p *DriveClient) AccessToken() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.token
+}
+
+// TokenExpiry returns when the current access token expires.
+func (p *DriveClient) TokenExpiry() time.Time {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.expiresAt
+}
+
+// IsTokenExpired reports whether the access token expires within margin.
+func (p *DriveClient) IsTokenExpired(margin time.Duration) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.token) == 0 || time.Now().Add(margin).After(p.expiresAt)
+}
+
+func signJwt(key *ServiceAccountKey, claims map[string]interface{}) (string, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", errors.New("InvalidPrivateKey")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return "", err
+		}
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("UnsupportedPrivateKey")
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": key.PrivateKeyId})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	content := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(content))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return content + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
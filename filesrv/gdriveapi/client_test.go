@@ -0,0 +1,137 @@
+package gdriveapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDrive serves the token endpoint and a small folder tree. The root
+// folder has two pages, a sub folder and two files.
+type fakeDrive struct {
+	lock      sync.Mutex
+	refresh   string
+	rotations int
+	token     string
+}
+
+func newFakeDrive(t *testing.T) (*fakeDrive, *DriveClient) {
+	drive := &fakeDrive{refresh: "refresh-0"}
+	server := httptest.NewServer(drive)
+	t.Cleanup(server.Close)
+	return drive, NewDriveClient(server.URL, server.URL+"/token")
+}
+
+func (p *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/token" {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != p.refresh {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Bad Request"}`)
+			return
+		}
+		p.rotations++
+		p.token = fmt.Sprintf("token-%d", p.rotations)
+		p.refresh = fmt.Sprintf("refresh-%d", p.rotations)
+		json.NewEncoder(w).Encode(GetTokenRsp{AccessToken: p.token, ExpiresIn: 3600, RefreshToken: p.refresh})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+p.token || len(r.URL.Query().Get("access_token")) != 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"code":401,"message":"Invalid Credentials","errors":[{"reason":"authError"}]}}`)
+		return
+	}
+	if r.URL.Path != "/files" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	pages := map[string][]FileList{
+		"'root' in parents and trashed = false": {
+			{NextPageToken: "page-2", Files: []File{
+				{Id: "sub", Name: "sub", MimeType: FolderMimeType},
+				{Id: "a", Name: "a.mkv", Md5Checksum: "00"},
+			}},
+			{Files: []File{{Id: "b", Name: "b.mkv", Md5Checksum: "01"}}},
+		},
+		"'sub' in parents and trashed = false": {
+			{Files: []File{{Id: "c", Name: "c.mkv", Md5Checksum: "02"}}},
+		},
+	}[r.URL.Query().Get("q")]
+	page := 0
+	if r.URL.Query().Get("pageToken") == "page-2" {
+		page = 1
+	}
+	if page >= len(pages) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pages[page])
+}
+
+func TestListFileRecursiveFollowsPagesAndFolders(t *testing.T) {
+	_, client := newFakeDrive(t)
+	if _, err := client.GetTokenByRefreshToken("id", "secret", "refresh-0"); err != nil {
+		t.Fatalf("get token: %v", err)
+	}
+	files, err := client.ListFileRecursive(context.Background(), "root", "")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Id+"="+f.Path)
+	}
+	sort.Strings(paths)
+	if want := "a=/a.mkv b=/b.mkv c=/sub/c.mkv"; strings.Join(paths, " ") != want {
+		t.Errorf("listed %v, want %s", paths, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.ListFileRecursive(ctx, "root", ""); err == nil || err.Err != "Canceled" {
+		t.Errorf("list after cancel: got %v", err)
+	}
+}
+
+func TestTokenRefreshAuthorizesLaterRequests(t *testing.T) {
+	drive, client := newFakeDrive(t)
+	if _, err := client.ListChild("root", "", ""); err == nil || err.Code != InvalidCredentials {
+		t.Fatalf("list without token: got %v", err)
+	}
+	token, err := client.GetTokenByRefreshToken("id", "secret", "refresh-0")
+	if err != nil {
+		t.Fatalf("get token: %v", err)
+	}
+	if token.RefreshToken != "refresh-1" || client.IsTokenExpired(10*time.Minute) {
+		t.Errorf("token after refresh: got %+v, expires at %v", token, client.TokenExpiry())
+	}
+	if _, err := client.GetTokenByRefreshToken("id", "secret", token.RefreshToken); err != nil {
+		t.Fatalf("refresh rotated token: %v", err)
+	}
+	if _, err := client.ListChild("root", "", ""); err != nil {
+		t.Errorf("list with the renewed token: %v", err)
+	}
+	if _, err := client.GetTokenByRefreshToken("id", "secret", "refresh-0"); err == nil || err.Code != InvalidTokenRequest || err.Err != "invalid_grant" {
+		t.Errorf("refresh with a used token: got %v", err)
+	}
+
+	drive.lock.Lock()
+	current := drive.token
+	drive.lock.Unlock()
+	downloadUrl := client.DownloadUrl("a")
+	if strings.Contains(downloadUrl, current) {
+		t.Errorf("download url %s carries the token", downloadUrl)
+	}
+	if header := client.AuthHeader().Get("Authorization"); header != "Bearer "+current {
+		t.Errorf("auth header: got %q", header)
+	}
+}
@@ -0,0 +1,69 @@
+package gdriveapi
+
+type (
+	ErrorReason struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+
+	ErrorMessage struct {
+		Code    int           `json:"code"`
+		Message string        `json:"message"`
+		Status  string        `json:"status"`
+		Errors  []ErrorReason `json:"errors"`
+	}
+
+	ErrorWrapper struct {
+		Error ErrorMessage `json:"error"`
+	}
+
+	// tokenErrorRsp is the error body of the OAuth token endpoint.
+	tokenErrorRsp struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+)
+
+type ApiCode int
+
+type ApiError struct {
+	Err        string
+	Code       ApiCode
+	Message    string
+	StatusCode int
+}
+
+const (
+	UnknownError        ApiCode = -1
+	TransportError      ApiCode = 1000
+	InvalidCredentials  ApiCode = 1001
+	NotFound            ApiCode = 1002
+	RateLimitExceeded   ApiCode = 1003
+	InvalidTokenRequest ApiCode = 1004
+)
+
+func (p ApiError) Error() string {
+	return p.Err + ": " + p.Message
+}
+
+func NewApiError(code ApiCode, errCode string, message string) *ApiError {
+	return &ApiError{Err: errCode, Code: code, Message: message}
+}
+
+func ParseError(statusCode int, e *ErrorWrapper) *ApiError {
+	reason := e.Error.Status
+	if len(e.Error.Errors) != 0 {
+		reason = e.Error.Errors[0].Reason
+	}
+	res := NewApiError(UnknownError, reason, e.Error.Message)
+	res.StatusCode = statusCode
+	switch {
+	case statusCode == 401:
+		res.Code = InvalidCredentials
+	case statusCode == 404:
+		res.Code = NotFound
+	case statusCode == 429 || reason == "rateLimitExceeded" || reason == "userRateLimitExceeded":
+		res.Code = RateLimitExceeded
+	}
+	return res
+}
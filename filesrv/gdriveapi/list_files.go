@@ -0,0 +1,119 @@
+package gdriveapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+const FolderMimeType = "application/vnd.google-apps.folder"
+
+type (
+	File struct {
+		Id             string   `json:"id"`
+		Name           string   `json:"name"`
+		MimeType       string   `json:"mimeType"`
+		Parents        []string `json:"parents"`
+		Size           string   `json:"size"`
+		DriveId        string   `json:"driveId"`
+		Md5Checksum    string   `json:"md5Checksum"`
+		Sha1Checksum   string   `json:"sha1Checksum"`
+		Sha256Checksum string   `json:"sha256Checksum"`
+		// Path is filled by ListFileRecursive and is not part of the API.
+		Path string `json:"-"`
+	}
+
+	FileList struct {
+		NextPageToken string `json:"nextPageToken"`
+		Files         []File `json:"files"`
+	}
+)
+
+const fileFields = "id,name,mimeType,parents,size,driveId,md5Checksum,sha1Checksum,sha256Checksum"
+
+// ListChild returns one page of the children of folderId. driveId names the
+// shared drive the folder belongs to and is empty for My Drive.
+func (p *DriveClient) ListChild(folderId string, driveId string, pageToken string) (*FileList, *ApiError) {
+	query := map[string]string{
+		"q":                         fmt.Sprintf("'%s' in parents and trashed = false", folderId),
+		"fields":                    "nextPageToken,files(" + fileFields + ")",
+		"pageSize":                  "1000",
+		"supportsAllDrives":         "true",
+		"includeItemsFromAllDrives": "true",
+	}
+	if len(driveId) != 0 {
+		query["corpora"] = "drive"
+		query["driveId"] = driveId
+	}
+	if len(pageToken) != 0 {
+		query["pageToken"] = pageToken
+	}
+	resp, err := p.HttpClient.
+		R().
+		SetAuthToken(p.AccessToken()).
+		SetQueryParams(query).
+		SetResult(&FileList{}).
+		SetError(&ErrorWrapper{}).
+		Get("/files")
+	if err != nil {
+		return nil, NewApiError(TransportError, "TransportError", err.Error())
+	}
+	if resp.IsError() {
+		return nil, ParseError(resp.StatusCode(), resp.Error().(*ErrorWrapper))
+	}
+	return resp.Result().(*FileList), nil
+}
+
+// ListFileRecursive lists every file below folderId, following page tokens
+// and descending into sub folders until ctx is canceled.
+func (p *DriveClient) ListFileRecursive(ctx context.Context, folderId string, driveId string) ([]File, *ApiError) {
+	type folder struct{ id, path string }
+
+	var res []File
+	pending := []folder{{folderId, "/"}}
+	for len(pending) != 0 {
+		current := pending[0]
+		pending = pending[1:]
+		pageToken := ""
+		for {
+			if err := ctx.Err(); err != nil {
+				return nil, NewApiError(TransportError, "Canceled", err.Error())
+			}
+			page, err := p.ListChild(current.id, driveId, pageToken)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range page.Files {
+				f.Path = path.Join(current.path, f.Name)
+				if f.MimeType == FolderMimeType {
+					pending = append(pending, folder{f.Id, f.Path})
+					continue
+				}
+				res = append(res, f)
+			}
+			if len(page.NextPageToken) == 0 {
+				break
+			}
+			pageToken = page.NextPageToken
+		}
+	}
+	return res, nil
+}
+
+// DownloadUrl returns a url serving the content of the file. It is only
+// served with the header of AuthHeader, the token is never put into the
+// url, so the url can't be handed to a client.
+func (p *DriveClient) DownloadUrl(fileId string) string {
+	return fmt.Sprintf("%s/files/%s?%s", p.BaseUrl, url.PathEscape(fileId), url.Values{
+		"alt":               {"media"},
+		"supportsAllDrives": {"true"},
+	}.Encode())
+}
+
+// AuthHeader returns the header authorizing a request with the current
+// access token.
+func (p *DriveClient) AuthHeader() http.Header {
+	return http.Header{"Authorization": {"Bearer " + p.AccessToken()}}
+}
@@ -0,0 +1,141 @@
+package msgraphapi
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ClientCertificate is the credential of an app registration that
+// authenticates with a certificate instead of a client secret.
+type ClientCertificate struct {
+	PrivateKey *rsa.PrivateKey
+	// Thumbprint is the SHA-1 hash of the DER encoded certificate, as shown
+	// on the certificates page of the app registration.
+	Thumbprint []byte
+}
+
+// LoadClientCertificate reads a PEM file holding the private key and the
+// certificate, or a PFX/PKCS#12 file protected by password, which may also
+// carry the issuing certificates of the chain. thumbprint is the hex
+// thumbprint of the certificate and is only required when the file doesn't
+// contain the certificate itself.
+func LoadClientCertificate(filename string, password string, thumbprint string) (*ClientCertificate, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		key  interface{}
+		cert *x509.Certificate
+	)
+	if strings.Contains(string(content), "-----BEGIN") {
+		for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "CERTIFICATE":
+				if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+					return nil, err
+				}
+			case "PRIVATE KEY":
+				if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+					return nil, err
+				}
+			case "RSA PRIVATE KEY":
+				if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+					return nil, err
+				}
+			}
+		}
+	} else if key, cert, _, err = pkcs12.DecodeChain(content, password); err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("RSAPrivateKeyNotFound")
+	}
+	res := &ClientCertificate{PrivateKey: privateKey}
+	if len(thumbprint) != 0 {
+		if res.Thumbprint, err = hex.DecodeString(strings.ReplaceAll(thumbprint, ":", "")); err != nil {
+			return nil, err
+		}
+	} else if cert != nil {
+		sum := sha1.Sum(cert.Raw)
+		res.Thumbprint = sum[:]
+	} else {
+		return nil, errors.New("CertificateThumbprintNotFound")
+	}
+	return res, nil
+}
+
+// assertion builds the signed JWT presented as client_assertion to the token
+// endpoint at audience.
+func (p *ClientCertificate) assertion(clientId string, audience string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(p.Thumbprint),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": clientId,
+		"sub": clientId,
+		"jti": hex.EncodeToString(nonce),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	content := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(content))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return content + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// GetTokenWithCertificate is the client credentials flow authenticated by a
+// certificate.
+func (p *MSGraphClient) GetTokenWithCertificate(clientId string, cert *ClientCertificate, scope string, tenantId string) (string, error) {
+	assertion, err := cert.assertion(clientId, fmt.Sprintf("%s/%s/oauth2/v2.0/token", p.LoginEndpoint, tenantId))
+	if err != nil {
+		return "", err
+	}
+	token, apiErr := p.requestToken(tenantId, map[string]string{
+		"client_id":             clientId,
+		"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+		"client_assertion":      assertion,
+		"scope":                 scope,
+		"grant_type":            "client_credentials",
+	})
+	if apiErr != nil {
+		return "", apiErr
+	}
+	p.setToken(token)
+	return token.AccessToken, nil
+}
@@ -0,0 +1,75 @@
+package msgraphapi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func newTestCertificate(t *testing.T, name string, key *rsa.PrivateKey, parent *x509.Certificate, parentKey *rsa.PrivateKey) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse %s: %v", name, err)
+	}
+	return cert
+}
+
+func TestLoadClientCertificateFromPfxWithChain(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate ca key: %v", err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	ca := newTestCertificate(t, "ca", caKey, nil, nil)
+	cert := newTestCertificate(t, "app", key, ca, caKey)
+	content, err := pkcs12.Encode(rand.Reader, key, cert, []*x509.Certificate{ca}, "secret")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	filename := filepath.Join(t.TempDir(), "app.pfx")
+	if err := os.WriteFile(filename, content, 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	res, err := LoadClientCertificate(filename, "secret", "")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if sum := sha1.Sum(cert.Raw); !bytes.Equal(res.Thumbprint, sum[:]) {
+		t.Errorf("thumbprint: got %x, want %x", res.Thumbprint, sum)
+	}
+	if !res.PrivateKey.Equal(key) {
+		t.Error("loaded another private key")
+	}
+	if _, err := LoadClientCertificate(filename, "wrong", ""); err == nil {
+		t.Error("loaded with a wrong password")
+	}
+}
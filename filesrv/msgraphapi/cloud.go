@@ -0,0 +1,70 @@
+package msgraphapi
+
+import (
+	"errors"
+	"strings"
+)
+
+// CloudEnvironment holds the endpoints of one Microsoft cloud. Tenants of the
+// national clouds can only sign in and call Graph through their own hosts.
+type CloudEnvironment struct {
+	Name          string
+	LoginEndpoint string
+	GraphEndpoint string
+}
+
+var (
+	GlobalCloud = CloudEnvironment{
+		Name:          "Global",
+		LoginEndpoint: "https://login.microsoftonline.com",
+		GraphEndpoint: "https://graph.microsoft.com",
+	}
+	// ChinaCloud is Microsoft 365 operated by 21Vianet.
+	ChinaCloud = CloudEnvironment{
+		Name:          "China",
+		LoginEndpoint: "https://login.chinacloudapi.cn",
+		GraphEndpoint: "https://microsoftgraph.chinacloudapi.cn",
+	}
+	// USGovCloud is Microsoft 365 GCC High (L4).
+	USGovCloud = CloudEnvironment{
+		Name:          "USGov",
+		LoginEndpoint: "https://login.microsoftonline.us",
+		GraphEndpoint: "https://graph.microsoft.us",
+	}
+	// USGovDoDCloud is Microsoft 365 DoD (L5).
+	USGovDoDCloud = CloudEnvironment{
+		Name:          "USGovDoD",
+		LoginEndpoint: "https://login.microsoftonline.us",
+		GraphEndpoint: "https://dod-graph.microsoft.us",
+	}
+)
+
+// LookupCloud returns the preset named name, matched case insensitively. An
+// empty name selects the global cloud.
+func LookupCloud(name string) (CloudEnvironment, error) {
+	if len(name) == 0 {
+		return GlobalCloud, nil
+	}
+	for _, c := range []CloudEnvironment{GlobalCloud, ChinaCloud, USGovCloud, USGovDoDCloud} {
+		if strings.EqualFold(c.Name, name) {
+			return c, nil
+		}
+	}
+	return CloudEnvironment{}, errors.New("CloudNotSupported")
+}
+
+// GraphBaseUrl is the v1.0 endpoint the api calls are sent to.
+func (p CloudEnvironment) GraphBaseUrl() string {
+	return strings.TrimSuffix(p.GraphEndpoint, "/") + "/v1.0"
+}
+
+// DefaultScope is the scope of the client credentials flow.
+func (p CloudEnvironment) DefaultScope() string {
+	return strings.TrimSuffix(p.GraphEndpoint, "/") + "/.default"
+}
+
+func NewMSGraphClientForCloud(cloud CloudEnvironment) *MSGraphClient {
+	client := NewMSGraphClient(cloud.GraphBaseUrl())
+	client.LoginEndpoint = strings.TrimSuffix(cloud.LoginEndpoint, "/")
+	return client
+}
@@ -1,5 +1,10 @@
 package msgraphapi
 
+import (
+	"net/http"
+	"strings"
+)
+
 type (
 	ErrorMessage struct {
 		Code    string `json:"code"`
@@ -14,27 +19,86 @@ type (
 type ApiCode int
 
 type ApiError struct {
-	Err     string
-	Code    ApiCode
-	Message string
+	Err        string
+	Code       ApiCode
+	Message    string
+	StatusCode int
 }
 
 const (
 	UnknownError               ApiCode = -1
 	InvalidAuthenticationToken ApiCode = 1000
+	InvalidGrant               ApiCode = 1001
+	TransportError             ApiCode = 1002
+	ItemNotFound               ApiCode = 1003
+	AccessDenied               ApiCode = 1004
+	Throttled                  ApiCode = 1005
+	ServiceUnavailable         ApiCode = 1006
+	InvalidRequest             ApiCode = 1007
+	ResyncRequired             ApiCode = 1008
 )
 
+// errorCodes maps the code strings of Graph error responses, compared case
+// insensitively, to ApiCode.
+var errorCodes = map[string]ApiCode{
+	"invalidauthenticationtoken":  InvalidAuthenticationToken,
+	"unauthenticated":             InvalidAuthenticationToken,
+	"itemnotfound":                ItemNotFound,
+	"accessdenied":                AccessDenied,
+	"authorization_requestdenied": AccessDenied,
+	"activitylimitreached":        Throttled,
+	"toomanyrequests":             Throttled,
+	"servicenotavailable":         ServiceUnavailable,
+	"invalidrequest":              InvalidRequest,
+	"badrequest":                  InvalidRequest,
+	"resyncrequired":              ResyncRequired,
+}
+
+// statusCodes is the fallback for error responses with unknown codes.
+var statusCodes = map[int]ApiCode{
+	http.StatusBadRequest:         InvalidRequest,
+	http.StatusUnauthorized:       InvalidAuthenticationToken,
+	http.StatusForbidden:          AccessDenied,
+	http.StatusNotFound:           ItemNotFound,
+	http.StatusGone:               ResyncRequired,
+	http.StatusTooManyRequests:    Throttled,
+	http.StatusServiceUnavailable: ServiceUnavailable,
+	http.StatusGatewayTimeout:     ServiceUnavailable,
+}
+
 func (p ApiError) Error() string {
 	return p.Err + ": " + p.Message
 }
 
 func NewApiError(code ApiCode, errCode string, message string) *ApiError {
-	return &ApiError{errCode, code, message}
+	return &ApiError{Err: errCode, Code: code, Message: message}
+}
+
+func (p *MSGraphClient) ParseError(statusCode int, e *ErrorWrapper) *ApiError {
+	code, ok := errorCodes[strings.ToLower(e.Error.Code)]
+	if !ok {
+		if code, ok = statusCodes[statusCode]; !ok {
+			code = UnknownError
+		}
+	}
+	errCode := e.Error.Code
+	if len(errCode) == 0 {
+		errCode = http.StatusText(statusCode)
+	}
+	res := NewApiError(code, errCode, e.Error.Message)
+	res.StatusCode = statusCode
+	return res
 }
 
-func (p *MSGraphClient) ParseError(e *ErrorWrapper) *ApiError {
-	if e.Error.Code == "InvalidAuthenticationToken" {
-		return NewApiError(InvalidAuthenticationToken, e.Error.Code, e.Error.Message)
+func (p *MSGraphClient) ParseTokenError(statusCode int, e *MSGraphTokenErrorRsp) *ApiError {
+	code := UnknownError
+	switch {
+	case e.Error == "invalid_grant":
+		code = InvalidGrant
+	case statusCode == http.StatusTooManyRequests:
+		code = Throttled
 	}
-	return NewApiError(UnknownError, e.Error.Code, e.Error.Message)
+	res := NewApiError(code, e.Error, e.ErrorDescription)
+	res.StatusCode = statusCode
+	return res
 }
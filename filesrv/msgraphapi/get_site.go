@@ -0,0 +1,69 @@
+package msgraphapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type (
+	SiteResource struct {
+		Id          string `json:"id"`
+		DisplayName string `json:"displayName"`
+		Name        string `json:"name"`
+		WebUrl      string `json:"webUrl"`
+	}
+
+	DriveResource struct {
+		Id        string `json:"id"`
+		Name      string `json:"name"`
+		DriveType string `json:"driveType"`
+		WebUrl    string `json:"webUrl"`
+	}
+)
+
+// GetSiteByUrl resolves a site url such as
+// https://contoso.sharepoint.com/sites/Media to the site resource.
+func (p *MSGraphClient) GetSiteByUrl(siteUrl string) (*SiteResource, error) {
+	u, err := url.Parse(siteUrl)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Host) == 0 {
+		return nil, errors.New("InvalidSiteUrl")
+	}
+	query := fmt.Sprintf("/sites/%s", u.Host)
+	if sitePath := strings.Trim(u.Path, "/"); len(sitePath) != 0 {
+		query = fmt.Sprintf("/sites/%s:/%s", u.Host, sitePath)
+	}
+	site := &SiteResource{}
+	if err := p.request(http.MethodGet, query, nil, site); err != nil {
+		return nil, err
+	}
+	return site, nil
+}
+
+// GetSiteDrive returns the document library of a site named driveName, or
+// the default library when driveName is empty.
+func (p *MSGraphClient) GetSiteDrive(siteId string, driveName string) (*DriveResource, error) {
+	if len(driveName) == 0 {
+		drive := &DriveResource{}
+		if err := p.request(http.MethodGet, fmt.Sprintf("/sites/%s/drive", siteId), nil, drive); err != nil {
+			return nil, err
+		}
+		return drive, nil
+	}
+	drives, _, err := listAll[DriveResource](context.Background(), p, fmt.Sprintf("/sites/%s/drives", siteId))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range drives {
+		if d.Name == driveName {
+			return &d, nil
+		}
+	}
+	return nil, errors.New("DriveNotFound")
+}
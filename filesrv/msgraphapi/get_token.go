@@ -1,7 +1,11 @@
 package msgraphapi
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 )
@@ -11,39 +15,165 @@ type MSGraphGetTokenRsp struct {
 	ExpiresIn    int    `json:"expires_in"`
 	ExtExpiresIn int    `json:"ext_expires_in"`
 	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type MSGraphDeviceCodeRsp struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationUri string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+}
+
+type MSGraphTokenErrorRsp struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
 type MSGraphClient struct {
-	Token         string
 	HttpClient    resty.Client
 	BaseUrl       string
 	DefaultUserId string
+	DrivePath     string
+	LoginEndpoint string
+
+	// lock guards the token, which a renewal replaces while requests are
+	// sent with it. expiresAt is when token stops being accepted by Graph.
+	lock      sync.RWMutex
+	token     string
+	expiresAt time.Time
 }
 
 func NewMSGraphClient(baseUrl string) *MSGraphClient {
 	client := &MSGraphClient{}
 	client.BaseUrl = baseUrl
+	client.LoginEndpoint = GlobalCloud.LoginEndpoint
 	client.HttpClient = *resty.New()
 	client.HttpClient.SetBaseURL(baseUrl)
 	return client
 }
 
 func (p *MSGraphClient) GetToken(clientId string, clientSecret string, scope string, tenantId string) (string, error) {
-	resp, err := p.HttpClient.
-		R().
-		EnableTrace().
-		SetResult(&MSGraphGetTokenRsp{}).
-		SetFormData(map[string]string{
-			"client_id":     clientId,
-			"client_secret": clientSecret,
-			"scope":         scope,
-			"grant_type":    "client_credentials",
-		}).
-		Post(fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", tenantId))
+	token, err := p.requestToken(tenantId, map[string]string{
+		"client_id":     clientId,
+		"client_secret": clientSecret,
+		"scope":         scope,
+		"grant_type":    "client_credentials",
+	})
 	if err != nil {
 		return "", err
 	}
-	p.Token = resp.Result().(*MSGraphGetTokenRsp).AccessToken
-	p.HttpClient.SetAuthToken(p.Token)
-	return p.Token, nil
+	p.setToken(token)
+	return token.AccessToken, nil
+}
+
+func (p *MSGraphClient) setToken(token *MSGraphGetTokenRsp) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.token = token.AccessToken
+	p.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+}
+
+// AccessToken returns the token Graph requests are authorized with.
+func (p *MSGraphClient) AccessToken() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.token
+}
+
+// TokenExpiry returns when the current access token expires.
+func (p *MSGraphClient) TokenExpiry() time.Time {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.expiresAt
+}
+
+// GetTokenByRefreshToken redeems the refresh token of a public client. The
+// response carries the rotated refresh token that must replace the old one.
+func (p *MSGraphClient) GetTokenByRefreshToken(clientId string, refreshToken string, scope string, tenantId string) (*MSGraphGetTokenRsp, *ApiError) {
+	token, err := p.requestToken(tenantId, map[string]string{
+		"client_id":     clientId,
+		"refresh_token": refreshToken,
+		"scope":         scope,
+		"grant_type":    "refresh_token",
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.setToken(token)
+	return token, nil
+}
+
+// RequestDeviceCode starts the device authorization flow, the user has to
+// visit VerificationUri and enter UserCode before PollDeviceCodeToken
+// succeeds.
+func (p *MSGraphClient) RequestDeviceCode(clientId string, scope string, tenantId string) (*MSGraphDeviceCodeRsp, *ApiError) {
+	code := &MSGraphDeviceCodeRsp{}
+	if err := p.loginRequest(fmt.Sprintf("%s/%s/oauth2/v2.0/devicecode", p.LoginEndpoint, tenantId), map[string]string{
+		"client_id": clientId,
+		"scope":     scope,
+	}, code); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// PollDeviceCodeToken waits until the user completed the device code login,
+// the code expired or the user declined it.
+func (p *MSGraphClient) PollDeviceCodeToken(clientId string, tenantId string, code *MSGraphDeviceCodeRsp) (*MSGraphGetTokenRsp, *ApiError) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		token, err := p.requestToken(tenantId, map[string]string{
+			"client_id":   clientId,
+			"device_code": code.DeviceCode,
+			"grant_type":  "urn:ietf:params:oauth:grant-type:device_code",
+		})
+		if err == nil {
+			p.setToken(token)
+			return token, nil
+		}
+		switch err.Err {
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		}
+		return nil, err
+	}
+	return nil, NewApiError(UnknownError, "expired_token", "device code expired before the login completed")
+}
+
+func (p *MSGraphClient) requestToken(tenantId string, form map[string]string) (*MSGraphGetTokenRsp, *ApiError) {
+	token := &MSGraphGetTokenRsp{}
+	if err := p.loginRequest(fmt.Sprintf("%s/%s/oauth2/v2.0/token", p.LoginEndpoint, tenantId), form, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// loginRequest posts form to an endpoint of the identity platform, whose
+// errors are reported in the OAuth format instead of the Graph one.
+func (p *MSGraphClient) loginRequest(url string, form map[string]string, result interface{}) *ApiError {
+	resp, err := p.execute(context.Background(), http.MethodPost, url, backgroundRetries, func() *resty.Request {
+		return p.HttpClient.
+			R().
+			SetResult(result).
+			SetError(&MSGraphTokenErrorRsp{}).
+			SetFormData(form)
+	})
+	if err != nil {
+		return NewApiError(TransportError, "TransportError", err.Error())
+	}
+	if resp.IsError() {
+		return p.ParseTokenError(resp.StatusCode(), resp.Error().(*MSGraphTokenErrorRsp))
+	}
+	return nil
 }
@@ -1,6 +1,9 @@
 package msgraphapi
 
-import "fmt"
+import (
+	"fmt"
+	"net/http"
+)
 
 type (
 	UserResourceSimple struct {
@@ -11,18 +14,20 @@ type (
 )
 
 func (p *MSGraphClient) GetUser(email string) (*UserResourceSimple, error) {
-	resp, err := p.HttpClient.
-		R().
-		EnableTrace().
-		SetResult(&UserResourceSimple{}).
-		Get(fmt.Sprintf("/users/%s", email))
-	if err != nil {
-		return &UserResourceSimple{}, err
+	user := &UserResourceSimple{}
+	if err := p.request(http.MethodGet, fmt.Sprintf("/users/%s", email), nil, user); err != nil {
+		return nil, err
 	}
-	user := resp.Result().(*UserResourceSimple)
 	return user, nil
 }
 
 func (p *MSGraphClient) SetDefaultUserId(userId string) {
 	p.DefaultUserId = userId
+	p.SetDrivePath(fmt.Sprintf("/users/%s/drive", userId))
+}
+
+// SetDrivePath selects the drive used by the drive item calls, such as
+// /users/{id}/drive or /me/drive.
+func (p *MSGraphClient) SetDrivePath(drivePath string) {
+	p.DrivePath = drivePath
 }
@@ -1,8 +1,11 @@
 package msgraphapi
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"net/url"
+	"strings"
 )
 
 type (
@@ -37,6 +40,12 @@ type (
 		ChildCount int `json:"childCount"`
 	}
 
+	DeletedFacet struct {
+		State string `json:"state"`
+	}
+
+	RootFacet struct{}
+
 	VideoResource struct {
 		AudioBitsPerSample    int32   `json:"audioBitsPerSample"`
 		AudioChannels         int32   `json:"audioChannels"`
@@ -76,45 +85,52 @@ type (
 		Size                 int64                `json:"size"`
 		Video                *VideoResource       `json:"video"`
 		DownloadUrl          string               `json:"@microsoft.graph.downloadUrl"`
+		Deleted              *DeletedFacet        `json:"deleted"`
+		Root                 *RootFacet           `json:"root"`
 		WebUrl               string               `json:"webUrl"`
 	}
 )
 
-type (
-	listChildRsp struct {
-		Context string      `json:"@odata.context"`
-		Value   []DriveItem `json:"value"`
+// itemPath escapes every segment of a drive path for the root:/path: form
+// of an item address.
+func itemPath(folderPath string) string {
+	segments := strings.Split(strings.Trim(folderPath, "/"), "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
 	}
-)
+	return strings.Join(segments, "/")
+}
 
-func (p *MSGraphClient) listChild(isId bool, pathOrId string) ([]DriveItem, error) {
+func (p *MSGraphClient) listChild(ctx context.Context, isId bool, pathOrId string) ([]DriveItem, error) {
 	var query string
 	if isId {
-		query = fmt.Sprintf("/users/%s/drive/items/%s/children", p.DefaultUserId, pathOrId)
+		query = fmt.Sprintf("%s/items/%s/children", p.DrivePath, pathOrId)
 	} else {
-		query = fmt.Sprintf("/users/%s/drive/root:/%s:/children", p.DefaultUserId, url.QueryEscape(pathOrId))
+		query = fmt.Sprintf("%s/root:/%s:/children", p.DrivePath, itemPath(pathOrId))
 	}
-	resp, err := p.HttpClient.
-		R().
-		EnableTrace().
-		SetResult(&listChildRsp{}).
-		Get(query)
+	items, _, err := listAll[DriveItem](ctx, p, query)
 	if err != nil {
 		return nil, err
 	}
-	return resp.Result().(*listChildRsp).Value, nil
+	return items, nil
 }
 
 func (p *MSGraphClient) ListChildByPath(path string) ([]DriveItem, error) {
-	return p.listChild(false, path)
+	return p.listChild(context.Background(), false, path)
 }
 
 func (p *MSGraphClient) ListChildByItemId(id string) ([]DriveItem, error) {
-	return p.listChild(true, id)
+	return p.listChild(context.Background(), true, id)
+}
+
+// ListChildByItemIdContext is ListChildByItemId stopping once ctx is
+// canceled.
+func (p *MSGraphClient) ListChildByItemIdContext(ctx context.Context, id string) ([]DriveItem, error) {
+	return p.listChild(ctx, true, id)
 }
 
 func (p *MSGraphClient) listFileRecursive(isId bool, pathOrId string) ([]DriveItem, error) {
-	files, err := p.listChild(isId, pathOrId)
+	files, err := p.listChild(context.Background(), isId, pathOrId)
 	if err != nil {
 		return nil, err
 	}
@@ -138,21 +154,20 @@ func (p *MSGraphClient) ListFileRecursiveByPath(path string) ([]DriveItem, error
 	return p.listFileRecursive(false, path)
 }
 
+// getDriveItem looks up one item while a user waits for its download url,
+// so throttled requests are only retried briefly.
 func (p *MSGraphClient) getDriveItem(isId bool, pathOrId string) (*DriveItem, *ApiError) {
 	var query string
 	if isId {
-		query = fmt.Sprintf("/users/%s/drive/items/%s", p.DefaultUserId, pathOrId)
+		query = fmt.Sprintf("%s/items/%s", p.DrivePath, pathOrId)
 	} else {
-		query = fmt.Sprintf("/users/%s/drive/root:/%s", p.DefaultUserId, url.QueryEscape(pathOrId))
+		query = fmt.Sprintf("%s/root:/%s", p.DrivePath, itemPath(pathOrId))
 	}
-	resp, err := p.HttpClient.R().EnableTrace().SetResult(&DriveItem{}).SetError(&ErrorWrapper{}).Get(query)
-	if err != nil {
-		return nil, p.ParseError(resp.Error().(*ErrorWrapper))
-	}
-	if resp.IsError() {
-		return nil, p.ParseError(resp.Error().(*ErrorWrapper))
+	item := &DriveItem{}
+	if err := p.requestWithin(context.Background(), interactiveRetries, http.MethodGet, query, nil, item); err != nil {
+		return nil, err
 	}
-	return resp.Result().(*DriveItem), nil
+	return item, nil
 }
 
 func (p *MSGraphClient) GetDriveItemByPath(path string) (*DriveItem, *ApiError) {
@@ -162,3 +177,24 @@ func (p *MSGraphClient) GetDriveItemByPath(path string) (*DriveItem, *ApiError)
 func (p *MSGraphClient) GetDriveItemById(id string) (*DriveItem, *ApiError) {
 	return p.getDriveItem(true, id)
 }
+
+// Delta returns the changes of the whole drive since deltaLink was issued
+// and the link to query the next changes with. An empty deltaLink enumerates
+// every item of the drive, parents before their children. A ResyncRequired
+// error means deltaLink expired and the enumeration has to start over. The
+// enumeration stops once ctx is canceled.
+func (p *MSGraphClient) Delta(ctx context.Context, deltaLink string) ([]DriveItem, string, *ApiError) {
+	return p.FolderDelta(ctx, "/", deltaLink)
+}
+
+// FolderDelta is Delta limited to the folder at folderPath and below, the
+// folder itself is the first item of an enumeration. Only personal drives
+// support it for folders other than the drive root.
+func (p *MSGraphClient) FolderDelta(ctx context.Context, folderPath string, deltaLink string) ([]DriveItem, string, *ApiError) {
+	if len(deltaLink) == 0 && len(strings.Trim(folderPath, "/")) == 0 {
+		deltaLink = fmt.Sprintf("%s/root/delta", p.DrivePath)
+	} else if len(deltaLink) == 0 {
+		deltaLink = fmt.Sprintf("%s/root:/%s:/delta", p.DrivePath, itemPath(folderPath))
+	}
+	return listAll[DriveItem](ctx, p, deltaLink)
+}
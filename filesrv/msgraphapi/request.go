@@ -0,0 +1,134 @@
+package msgraphapi
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// retryBudget bounds the retries of a request.
+type retryBudget struct {
+	retries          int
+	transportRetries int
+	maxDelay         time.Duration
+}
+
+var (
+	// backgroundRetries wait out throttling, refreshes and listings have
+	// the time.
+	backgroundRetries = retryBudget{retries: 6, transportRetries: 2, maxDelay: 2 * time.Minute}
+	// interactiveRetries give up early, a user is waiting for the call.
+	interactiveRetries = retryBudget{retries: 2, transportRetries: 1, maxDelay: 5 * time.Second}
+)
+
+type pageRsp[T any] struct {
+	Context   string `json:"@odata.context"`
+	NextLink  string `json:"@odata.nextLink"`
+	DeltaLink string `json:"@odata.deltaLink"`
+	Value     []T    `json:"value"`
+}
+
+// execute sends the request produced by newRequest. Throttled (429) and
+// unavailable (503, 504) responses are retried, waiting as long as
+// Retry-After asks for or backing off exponentially, within budget.
+// Transport failures are retried fewer times. Waiting stops with ctx.Err()
+// once ctx is canceled.
+// The returned response may still be an error response.
+func (p *MSGraphClient) execute(ctx context.Context, method string, url string, budget retryBudget, newRequest func() *resty.Request) (*resty.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := newRequest().SetContext(ctx).Execute(method, url)
+		if attempt == budget.retries || (err != nil && attempt == budget.transportRetries) || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil && !isRetryable(resp.StatusCode()) {
+			return resp, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryDelay(resp, attempt, budget.maxDelay)):
+		}
+	}
+}
+
+func isRetryable(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests ||
+		statusCode == http.StatusServiceUnavailable ||
+		statusCode == http.StatusGatewayTimeout
+}
+
+func retryDelay(resp *resty.Response, attempt int, maxDelay time.Duration) time.Duration {
+	if resp != nil {
+		if value := resp.Header().Get("Retry-After"); len(value) != 0 {
+			if seconds, err := strconv.Atoi(value); err == nil {
+				return minDuration(time.Duration(seconds)*time.Second, maxDelay)
+			}
+			if at, err := http.ParseTime(value); err == nil {
+				return minDuration(time.Until(at), maxDelay)
+			}
+		}
+	}
+	backoff := time.Second << attempt
+	return minDuration(backoff+time.Duration(rand.Int63n(int64(backoff/2)+1)), maxDelay)
+}
+
+func minDuration(a time.Duration, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// request is the single entry of Graph api calls. result receives the
+// decoded body of a successful response and may be nil.
+func (p *MSGraphClient) request(method string, url string, body interface{}, result interface{}) *ApiError {
+	return p.requestWithin(context.Background(), backgroundRetries, method, url, body, result)
+}
+
+// requestWithin is request with the retries bounded by budget, it gives up
+// once ctx is canceled.
+func (p *MSGraphClient) requestWithin(ctx context.Context, budget retryBudget, method string, url string, body interface{}, result interface{}) *ApiError {
+	resp, err := p.execute(ctx, method, url, budget, func() *resty.Request {
+		req := p.HttpClient.R().EnableTrace().SetAuthToken(p.AccessToken()).SetError(&ErrorWrapper{})
+		if result != nil {
+			req.SetResult(result)
+		}
+		if body != nil {
+			req.SetBody(body)
+		}
+		return req
+	})
+	if err != nil && ctx.Err() != nil {
+		return NewApiError(TransportError, "Canceled", err.Error())
+	} else if err != nil {
+		return NewApiError(TransportError, "TransportError", err.Error())
+	}
+	if resp.IsError() {
+		return p.ParseError(resp.StatusCode(), resp.Error().(*ErrorWrapper))
+	}
+	return nil
+}
+
+// listAll collects every page of a collection by following @odata.nextLink.
+// The delta link of the last page is returned for delta queries.
+func listAll[T any](ctx context.Context, p *MSGraphClient, url string) ([]T, string, *ApiError) {
+	var res []T
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, "", NewApiError(TransportError, "Canceled", err.Error())
+		}
+		page := pageRsp[T]{}
+		if err := p.requestWithin(ctx, backgroundRetries, http.MethodGet, url, nil, &page); err != nil {
+			return nil, "", err
+		}
+		res = append(res, page.Value...)
+		if len(page.NextLink) == 0 {
+			return res, page.DeltaLink, nil
+		}
+		url = page.NextLink
+	}
+}
@@ -0,0 +1,56 @@
+package msgraphapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUserFacingCallsRetryLess(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	client := NewMSGraphClient(server.URL)
+	client.SetDrivePath("/me/drive")
+
+	if _, err := client.GetDriveItemById("item"); err == nil {
+		t.Fatal("throttled lookup succeeded")
+	}
+	if got, want := atomic.SwapInt32(&requests, 0), int32(interactiveRetries.retries+1); got != want {
+		t.Errorf("lookup sent %d requests, want %d", got, want)
+	}
+	if _, _, err := client.Delta(context.Background(), ""); err == nil {
+		t.Fatal("throttled delta succeeded")
+	}
+	if got, want := atomic.SwapInt32(&requests, 0), int32(backgroundRetries.retries+1); got != want {
+		t.Errorf("delta sent %d requests, want %d", got, want)
+	}
+}
+
+func TestRetriesStopWhenCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	client := NewMSGraphClient(server.URL)
+	client.SetDrivePath("/me/drive")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := client.Delta(ctx, "")
+	if err == nil || err.Err != "Canceled" {
+		t.Errorf("canceled delta: got %v, want Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("canceled delta returned after %v", elapsed)
+	}
+}
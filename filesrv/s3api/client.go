@@ -0,0 +1,199 @@
+package s3api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	signAlgorithm      = "AWS4-HMAC-SHA256"
+	timeFormat         = "20060102T150405Z"
+	shortTimeFormat    = "20060102"
+	emptyPayloadHash   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayload    = "UNSIGNED-PAYLOAD"
+	defaultServiceName = "s3"
+)
+
+type S3Client struct {
+	HttpClient      resty.Client
+	Endpoint        *url.URL
+	Region          string
+	Bucket          string
+	PathStyle       bool
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// NewS3Client creates a client for one bucket of an S3 compatible service.
+// Path style addressing (http://host/bucket/key) is what MinIO and most self
+// hosted services expect, virtual hosted style (http://bucket.host/key) is
+// the AWS default.
+func NewS3Client(endpoint string, region string, bucket string, pathStyle bool) (*S3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("InvalidEndpoint: %s", endpoint)
+	}
+	client := &S3Client{
+		Endpoint:  u,
+		Region:    region,
+		Bucket:    bucket,
+		PathStyle: pathStyle,
+	}
+	client.HttpClient = *resty.New()
+	client.HttpClient.SetPreRequestHook(func(c *resty.Client, req *http.Request) error {
+		client.sign(req, time.Now())
+		return nil
+	})
+	return client, nil
+}
+
+func (p *S3Client) SetCredentials(accessKeyId string, secretAccessKey string, sessionToken string) {
+	p.AccessKeyId = accessKeyId
+	p.SecretAccessKey = secretAccessKey
+	p.SessionToken = sessionToken
+}
+
+// ObjectUrl returns the unsigned url of key.
+func (p *S3Client) ObjectUrl(key string) *url.URL {
+	u := *p.Endpoint
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if p.PathStyle {
+		basePath += "/" + p.Bucket
+	} else {
+		u.Host = p.Bucket + "." + u.Host
+	}
+	u.Path = basePath + "/" + key
+	u.RawPath = encodePath(basePath) + "/" + encodePath(key)
+	return &u
+}
+
+func (p *S3Client) bucketUrl() *url.URL {
+	u := p.ObjectUrl("")
+	if p.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	}
+	return u
+}
+
+func (p *S3Client) sign(req *http.Request, now time.Time) {
+	if len(p.AccessKeyId) == 0 {
+		return
+	}
+	now = now.UTC()
+	req.Header.Set("x-amz-date", now.Format(timeFormat))
+	req.Header.Set("x-amz-content-sha256", emptyPayloadHash)
+	if len(p.SessionToken) != 0 {
+		req.Header.Set("x-amz-security-token", p.SessionToken)
+	}
+
+	signedHeaders := []string{"host"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n"
+	var amzHeaders []string
+	for k := range req.Header {
+		if lower := strings.ToLower(k); strings.HasPrefix(lower, "x-amz-") {
+			amzHeaders = append(amzHeaders, lower)
+		}
+	}
+	sort.Strings(amzHeaders)
+	for _, k := range amzHeaders {
+		signedHeaders = append(signedHeaders, k)
+		canonicalHeaders += k + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		emptyPayloadHash,
+	}, "\n")
+	scope := p.scope(now)
+	signature := p.signature(now, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, p.AccessKeyId, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func (p *S3Client) scope(now time.Time) string {
+	return strings.Join([]string{now.Format(shortTimeFormat), p.Region, defaultServiceName, "aws4_request"}, "/")
+}
+
+func (p *S3Client) signature(now time.Time, scope string, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		now.Format(timeFormat),
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+	key := hmacSum([]byte("AWS4"+p.SecretAccessKey), now.Format(shortTimeFormat))
+	key = hmacSum(key, p.Region)
+	key = hmacSum(key, defaultServiceName)
+	key = hmacSum(key, "aws4_request")
+	return hex.EncodeToString(hmacSum(key, stringToSign))
+}
+
+func hmacSum(key []byte, content string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(content))
+	return h.Sum(nil)
+}
+
+func hashHex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string{}, values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, encodeComponent(k)+"="+encodeComponent(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// encodeComponent escapes everything except the unreserved characters, as
+// required by the signature version 4 canonical form.
+func encodeComponent(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func encodePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = encodeComponent(s)
+	}
+	return strings.Join(segments, "/")
+}
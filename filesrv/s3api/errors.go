@@ -0,0 +1,32 @@
+package s3api
+
+import "encoding/xml"
+
+type ErrorMessage struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Key       string   `xml:"Key"`
+	RequestId string   `xml:"RequestId"`
+}
+
+type ApiError struct {
+	Code       string
+	Message    string
+	StatusCode int
+}
+
+func (p ApiError) Error() string {
+	return p.Code + ": " + p.Message
+}
+
+func NewApiError(statusCode int, code string, message string) *ApiError {
+	return &ApiError{code, message, statusCode}
+}
+
+func (p *S3Client) ParseError(statusCode int, e *ErrorMessage) *ApiError {
+	if e == nil || len(e.Code) == 0 {
+		return NewApiError(statusCode, "UnknownError", "")
+	}
+	return NewApiError(statusCode, e.Code, e.Message)
+}
@@ -0,0 +1,42 @@
+package s3api
+
+import (
+	"net/http"
+	"strings"
+)
+
+type ObjectChecksums struct {
+	ETag   string
+	CRC32  string
+	CRC32C string
+	SHA1   string
+	SHA256 string
+}
+
+// HeadObject reads the metadata of key, including the additional checksums
+// stored with the object. Checksums are base64 encoded as returned by the
+// service.
+func (p *S3Client) HeadObject(key string) (*ObjectChecksums, *ApiError) {
+	resp, err := p.HttpClient.
+		R().
+		SetHeader("x-amz-checksum-mode", "ENABLED").
+		Head(p.ObjectUrl(key).String())
+	if err != nil {
+		return nil, NewApiError(0, "TransportError", err.Error())
+	}
+	if resp.IsError() {
+		code := "UnknownError"
+		if resp.StatusCode() == http.StatusNotFound {
+			code = "NoSuchKey"
+		}
+		return nil, NewApiError(resp.StatusCode(), code, resp.Status())
+	}
+	header := resp.Header()
+	return &ObjectChecksums{
+		ETag:   strings.Trim(header.Get("ETag"), "\""),
+		CRC32:  header.Get("x-amz-checksum-crc32"),
+		CRC32C: header.Get("x-amz-checksum-crc32c"),
+		SHA1:   header.Get("x-amz-checksum-sha1"),
+		SHA256: header.Get("x-amz-checksum-sha256"),
+	}, nil
+}
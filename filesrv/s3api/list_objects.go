@@ -0,0 +1,75 @@
+package s3api
+
+import (
+	"context"
+	"encoding/xml"
+	"time"
+)
+
+type (
+	Object struct {
+		Key               string    `xml:"Key"`
+		LastModified      time.Time `xml:"LastModified"`
+		ETag              string    `xml:"ETag"`
+		Size              int64     `xml:"Size"`
+		StorageClass      string    `xml:"StorageClass"`
+		ChecksumAlgorithm []string  `xml:"ChecksumAlgorithm"`
+	}
+
+	ListBucketResult struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string   `xml:"Name"`
+		Prefix                string   `xml:"Prefix"`
+		KeyCount              int      `xml:"KeyCount"`
+		IsTruncated           bool     `xml:"IsTruncated"`
+		NextContinuationToken string   `xml:"NextContinuationToken"`
+		Contents              []Object `xml:"Contents"`
+	}
+)
+
+func (p *S3Client) ListObjectsV2(prefix string, continuationToken string) (*ListBucketResult, *ApiError) {
+	query := map[string]string{
+		"list-type": "2",
+		"prefix":    prefix,
+	}
+	if len(continuationToken) != 0 {
+		query["continuation-token"] = continuationToken
+	}
+	resp, err := p.HttpClient.
+		R().
+		SetQueryParams(query).
+		SetResult(&ListBucketResult{}).
+		SetError(&ErrorMessage{}).
+		ForceContentType("application/xml").
+		Get(p.bucketUrl().String())
+	if err != nil {
+		return nil, NewApiError(0, "TransportError", err.Error())
+	}
+	if resp.IsError() {
+		return nil, p.ParseError(resp.StatusCode(), resp.Error().(*ErrorMessage))
+	}
+	return resp.Result().(*ListBucketResult), nil
+}
+
+// ListAllObjects lists every object under prefix, following continuation
+// tokens until the listing is complete or ctx is canceled.
+func (p *S3Client) ListAllObjects(ctx context.Context, prefix string) ([]Object, *ApiError) {
+	var (
+		res   []Object
+		token string
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, NewApiError(0, "Canceled", err.Error())
+		}
+		page, err := p.ListObjectsV2(prefix, token)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, page.Contents...)
+		if !page.IsTruncated || len(page.NextContinuationToken) == 0 {
+			return res, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
@@ -0,0 +1,47 @@
+package s3api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxPresignExpires is the longest expiry signature version 4 accepts.
+const maxPresignExpires = 7 * 24 * time.Hour
+
+// PresignGetObject returns a url that allows downloading key without
+// credentials until expires has passed, at most maxPresignExpires.
+func (p *S3Client) PresignGetObject(key string, expires time.Duration) string {
+	return p.presignGetObject(key, expires, time.Now())
+}
+
+func (p *S3Client) presignGetObject(key string, expires time.Duration, now time.Time) string {
+	if expires > maxPresignExpires {
+		expires = maxPresignExpires
+	}
+	now = now.UTC()
+	u := p.ObjectUrl(key)
+	scope := p.scope(now)
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", signAlgorithm)
+	query.Set("X-Amz-Credential", p.AccessKeyId+"/"+scope)
+	query.Set("X-Amz-Date", now.Format(timeFormat))
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int64(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if len(p.SessionToken) != 0 {
+		query.Set("X-Amz-Security-Token", p.SessionToken)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	signature := p.signature(now, scope, canonicalRequest)
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return u.String()
+}
@@ -0,0 +1,182 @@
+package source
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tickstep/aliyunpan-api/aliyunpan"
+	"github.com/tickstep/aliyunpan-api/aliyunpan/apierror"
+	"xxtuitui.com/filesvr/aliyunpanapi"
+)
+
+type (
+	// aliyunpanClient is the part of the Aliyunpan api used by AliyunpanSource.
+	// It is implemented for the private web api and for the open platform,
+	// both report errors with the codes of aliyunpanapi.
+	aliyunpanClient interface {
+		// Authorize exchanges the refresh token for an access token, the
+		// returned token carries the rotated refresh token.
+		Authorize(refreshToken string) (*aliyunpanToken, error)
+		Drives() (*aliyunpanapi.UserDrives, error)
+		ListFiles(driveId string, parentFileId string) ([]aliyunpanapi.File, *aliyunpanapi.ApiError)
+		GetFile(driveId string, fileId string) (*aliyunpanapi.File, *aliyunpanapi.ApiError)
+		GetDownloadUrl(driveId string, fileId string, expireSec int) (string, *aliyunpanapi.ApiError)
+	}
+
+	aliyunpanToken struct {
+		RefreshToken string
+		ExpiresIn    int
+	}
+
+	// aliyunpanWebClient replaces its PanClient on every authorization,
+	// PanClient.UpdateToken isn't safe while the client is in use.
+	aliyunpanWebClient struct {
+		lock sync.RWMutex
+		pan  *aliyunpan.PanClient
+		web  *aliyunpanapi.WebClient
+	}
+
+	aliyunpanOpenClient struct {
+		open *aliyunpanapi.OpenClient
+	}
+)
+
+func (p *aliyunpanWebClient) Authorize(refreshToken string) (*aliyunpanToken, error) {
+	webToken, err := aliyunpan.GetAccessTokenFromRefreshToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	pan := aliyunpan.NewPanClient(*webToken, aliyunpan.AppLoginToken{})
+	p.lock.Lock()
+	p.pan = pan
+	if p.web == nil {
+		p.web = aliyunpanapi.NewWebClient("")
+	}
+	p.web.SetToken(webToken.AccessToken)
+	p.lock.Unlock()
+	return &aliyunpanToken{RefreshToken: webToken.RefreshToken, ExpiresIn: webToken.ExpiresIn}, nil
+}
+
+// clients returns the clients of the last authorization.
+func (p *aliyunpanWebClient) clients() (*aliyunpan.PanClient, *aliyunpanapi.WebClient) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.pan, p.web
+}
+
+func (p *aliyunpanWebClient) Drives() (*aliyunpanapi.UserDrives, error) {
+	pan, web := p.clients()
+	user, err := pan.GetUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	drives, apiErr := web.GetUserDrives()
+	if apiErr != nil {
+		// Only the resource drive is missing without it.
+		logrus.WithFields(logrus.Fields{
+			"errCode": apiErr.Code,
+			"err":     apiErr.Message,
+		}).Warn("AliyunpanGetUserDrivesFailed")
+		drives = &aliyunpanapi.UserDrives{}
+	}
+	drives.AlbumDriveId = user.AlbumDriveId
+	if len(drives.DefaultDriveId) == 0 {
+		drives.DefaultDriveId = user.FileDriveId
+		drives.BackupDriveId = user.FileDriveId
+	}
+	return drives, nil
+}
+
+func (p *aliyunpanWebClient) ListFiles(driveId string, parentFileId string) ([]aliyunpanapi.File, *aliyunpanapi.ApiError) {
+	pan, _ := p.clients()
+	entities, err := pan.FileListGetAll(&aliyunpan.FileListParam{
+		DriveId:      driveId,
+		ParentFileId: parentFileId,
+	}, 0)
+	if err != nil {
+		return nil, fromPanApiError(err)
+	}
+	res := make([]aliyunpanapi.File, 0, len(entities))
+	for _, f := range entities {
+		res = append(res, fromFileEntity(f))
+	}
+	return res, nil
+}
+
+func (p *aliyunpanWebClient) GetFile(driveId string, fileId string) (*aliyunpanapi.File, *aliyunpanapi.ApiError) {
+	pan, _ := p.clients()
+	entity, err := pan.FileInfoById(driveId, fileId)
+	if err != nil {
+		return nil, fromPanApiError(err)
+	}
+	res := fromFileEntity(entity)
+	return &res, nil
+}
+
+func (p *aliyunpanWebClient) GetDownloadUrl(driveId string, fileId string, expireSec int) (string, *aliyunpanapi.ApiError) {
+	pan, _ := p.clients()
+	res, err := pan.GetFileDownloadUrl(&aliyunpan.GetFileDownloadUrlParam{
+		DriveId:   driveId,
+		FileId:    fileId,
+		ExpireSec: expireSec,
+	})
+	if err != nil {
+		return "", fromPanApiError(err)
+	}
+	return res.Url, nil
+}
+
+func fromFileEntity(f *aliyunpan.FileEntity) aliyunpanapi.File {
+	return aliyunpanapi.File{
+		DriveId:         f.DriveId,
+		FileId:          f.FileId,
+		Name:            f.FileName,
+		Type:            f.FileType,
+		ParentFileId:    f.ParentFileId,
+		Size:            f.FileSize,
+		ContentHash:     f.ContentHash,
+		ContentHashName: f.ContentHashName,
+		UpdatedAt:       f.UpdatedAt,
+	}
+}
+
+func fromPanApiError(err *apierror.ApiError) *aliyunpanapi.ApiError {
+	code := aliyunpanapi.UnknownError
+	switch err.ErrCode() {
+	case apierror.ApiCodeFileNotFoundCode:
+		code = aliyunpanapi.NotFound
+	case apierror.ApiCodeAccessTokenInvalid, apierror.ApiCodeTokenExpiredCode:
+		code = aliyunpanapi.AccessTokenInvalid
+	case apierror.ApiCodeNetError:
+		code = aliyunpanapi.TransportError
+	}
+	return aliyunpanapi.NewApiError(0, code, err.Error())
+}
+
+func (p *aliyunpanOpenClient) Authorize(refreshToken string) (*aliyunpanToken, error) {
+	token, err := p.open.GetTokenByRefreshToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	return &aliyunpanToken{RefreshToken: token.RefreshToken, ExpiresIn: token.ExpiresIn}, nil
+}
+
+func (p *aliyunpanOpenClient) Drives() (*aliyunpanapi.UserDrives, error) {
+	drives, err := p.open.GetDriveInfo()
+	if err != nil {
+		return nil, err
+	}
+	return drives, nil
+}
+
+func (p *aliyunpanOpenClient) ListFiles(driveId string, parentFileId string) ([]aliyunpanapi.File, *aliyunpanapi.ApiError) {
+	return p.open.ListFiles(driveId, parentFileId)
+}
+
+func (p *aliyunpanOpenClient) GetFile(driveId string, fileId string) (*aliyunpanapi.File, *aliyunpanapi.ApiError) {
+	return p.open.GetFile(driveId, fileId)
+}
+
+func (p *aliyunpanOpenClient) GetDownloadUrl(driveId string, fileId string, expireSec int) (string, *aliyunpanapi.ApiError) {
+	return p.open.GetDownloadUrl(driveId, fileId, expireSec)
+}
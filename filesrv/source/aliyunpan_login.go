@@ -0,0 +1,205 @@
+package source
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/skip2/go-qrcode"
+	"xxtuitui.com/filesvr/aliyunpanapi"
+	"xxtuitui.com/filesvr/config"
+)
+
+type (
+	// AliyunpanLoginState is the progress of a QR code login as shown by the
+	// admin endpoint.
+	AliyunpanLoginState struct {
+		SourceName  string    `json:"sourceName"`
+		Status      string    `json:"status"`
+		CodeContent string    `json:"codeContent"`
+		StartTime   time.Time `json:"startTime"`
+		Err         string    `json:"err,omitempty"`
+	}
+
+	aliyunpanLoginSession struct {
+		state   AliyunpanLoginState
+		context *CacheSourceContext
+		running bool
+	}
+
+	// AliyunpanLoginManager runs QR code logins that fill the refresh token of
+	// Aliyunpan sources.
+	AliyunpanLoginManager struct {
+		lock     sync.Mutex
+		sessions map[string]*aliyunpanLoginSession
+	}
+)
+
+const (
+	// AliyunpanLoginFailed is the status of a login that gave up.
+	AliyunpanLoginFailed = "FAILED"
+
+	aliyunpanLoginPollInterval = 2 * time.Second
+	aliyunpanLoginMaxQrCodes   = 5
+)
+
+var AliyunpanLogins = &AliyunpanLoginManager{sessions: make(map[string]*aliyunpanLoginSession)}
+
+// Start begins a QR code login for the source, unless one is running. The
+// context is needed for sources that could not be restored yet, it may be
+// nil when the source is already running.
+func (p *AliyunpanLoginManager) Start(sourceName string, context *CacheSourceContext) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	session, ok := p.sessions[sourceName]
+	if ok && session.running {
+		return nil
+	}
+	if context == nil && ok {
+		context = session.context
+	}
+	s, running := Manager.GetSource(sourceName).(*AliyunpanSource)
+	if context == nil && !running {
+		return errors.New("SourceNotFound")
+	}
+	// QR code logins issue web api tokens, the open platform has its own.
+	if running && s.Context.ClientMode != AliyunpanClientWeb {
+		return errors.New("ClientModeNotSupported")
+	}
+	session = &aliyunpanLoginSession{
+		state: AliyunpanLoginState{
+			SourceName: sourceName,
+			Status:     aliyunpanapi.QrCodeNew,
+			StartTime:  time.Now(),
+		},
+		context: context,
+		running: true,
+	}
+	p.sessions[sourceName] = session
+	go p.run(session)
+	return nil
+}
+
+// State returns a copy of the latest login state of the source.
+func (p *AliyunpanLoginManager) State(sourceName string) (AliyunpanLoginState, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	session, ok := p.sessions[sourceName]
+	if !ok {
+		return AliyunpanLoginState{}, false
+	}
+	return session.state, true
+}
+
+func (p *AliyunpanLoginManager) update(session *aliyunpanLoginSession, f func(state *AliyunpanLoginState)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	f(&session.state)
+}
+
+func (p *AliyunpanLoginManager) run(session *aliyunpanLoginSession) {
+	sourceName := session.state.SourceName
+	refreshToken, err := p.waitForLogin(session)
+	if err == nil {
+		err = p.applyRefreshToken(session, refreshToken)
+	}
+	p.update(session, func(state *AliyunpanLoginState) {
+		if err != nil {
+			state.Status = AliyunpanLoginFailed
+			state.Err = err.Error()
+		}
+		state.CodeContent = ""
+		session.running = false
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"sourceName": sourceName,
+			"err":        err,
+		}).Error("AliyunpanQrCodeLoginFailed")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"sourceName": sourceName,
+	}).Info("AliyunpanQrCodeLoginSucceeded")
+}
+
+// waitForLogin shows QR codes until one is confirmed in the app, a new code
+// replaces an expired one.
+func (p *AliyunpanLoginManager) waitForLogin(session *aliyunpanLoginSession) (string, error) {
+	web := aliyunpanapi.NewWebClient("")
+	for i := 0; i < aliyunpanLoginMaxQrCodes; i++ {
+		code, err := web.GenerateQrCode()
+		if err != nil {
+			return "", err
+		}
+		p.update(session, func(state *AliyunpanLoginState) {
+			state.Status = aliyunpanapi.QrCodeNew
+			state.CodeContent = code.CodeContent
+		})
+		printQrCode(session.state.SourceName, code.CodeContent)
+
+	poll:
+		for {
+			time.Sleep(aliyunpanLoginPollInterval)
+			status, err := web.QueryQrCode(code)
+			if err != nil {
+				return "", err
+			}
+			p.update(session, func(state *AliyunpanLoginState) {
+				state.Status = status.Status
+			})
+			switch status.Status {
+			case aliyunpanapi.QrCodeConfirmed:
+				return status.RefreshToken, nil
+			case aliyunpanapi.QrCodeCanceled:
+				return "", errors.New("LoginCanceled")
+			case aliyunpanapi.QrCodeExpired:
+				break poll
+			}
+		}
+	}
+	return "", errors.New("QrCodeExpired")
+}
+
+// applyRefreshToken hands the token to the running source, or restores the
+// source that was waiting for it, and saves its context.
+func (p *AliyunpanLoginManager) applyRefreshToken(session *aliyunpanLoginSession, refreshToken string) error {
+	if s, ok := Manager.GetSource(session.state.SourceName).(*AliyunpanSource); ok {
+		return s.login(refreshToken)
+	}
+	sourceContext, err := DecodeContext[AliyunpanContext](session.context)
+	if err != nil {
+		return err
+	}
+	config.Update(func() {
+		sourceContext.RefreshToken = refreshToken
+	})
+	// The token is saved first, restoring takes over the stored tokens.
+	if err := saveRecord(session.context); err != nil {
+		return err
+	}
+	return Manager.Restore(session.context)
+}
+
+func printQrCode(sourceName string, content string) {
+	logrus.WithFields(logrus.Fields{
+		"sourceName":  sourceName,
+		"codeContent": content,
+	}).Warn("AliyunpanQrCodeLoginRequired")
+	code, err := qrcode.New(content, qrcode.Low)
+	if err != nil {
+		return
+	}
+	fmt.Println(code.ToSmallString(false))
+}
+
+// AliyunpanQrCodePng renders the QR code of the running login of the source.
+func AliyunpanQrCodePng(sourceName string, size int) ([]byte, error) {
+	state, ok := AliyunpanLogins.State(sourceName)
+	if !ok || len(state.CodeContent) == 0 {
+		return nil, errors.New("QrCodeNotFound")
+	}
+	return qrcode.Encode(state.CodeContent, qrcode.Medium, size)
+}
@@ -0,0 +1,284 @@
+package source
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tickstep/aliyunpan-api/aliyunpan"
+	"xxtuitui.com/filesvr/aliyunpanapi"
+	"xxtuitui.com/filesvr/config"
+)
+
+type (
+	// AliyunpanFolder is the part of a folder kept between refreshes. Aliyunpan
+	// bumps updated_at of a folder when its direct entries change, but not of
+	// the folders above it, so a folder with the same updated_at can reuse the
+	// entries of the last refresh and every folder has to be checked.
+	// UpdatedAt is taken from the listing of the parent, the sub folders of a
+	// reused folder are looked up one by one, which is a single call instead
+	// of the pages of a listing.
+	AliyunpanFolder struct {
+		Id        string `json:"id"`
+		DriveId   string `json:"driveId"`
+		Name      string `json:"name"`
+		ParentId  string `json:"parentId"`
+		UpdatedAt string `json:"updatedAt"`
+	}
+
+	// AliyunpanPendingFolder is a folder waiting to be visited. UpdatedAt is
+	// empty when it is not known yet.
+	AliyunpanPendingFolder struct {
+		Id        string `json:"id"`
+		DriveId   string `json:"driveId"`
+		Name      string `json:"name"`
+		ParentId  string `json:"parentId"`
+		Path      string `json:"path"`
+		UpdatedAt string `json:"updatedAt"`
+	}
+
+	// AliyunpanRefreshState is the progress of a refresh, it is saved to the
+	// context file periodically so an interrupted refresh continues where it
+	// stopped. Folders are keyed by aliyunpanFolderKey. The refresh works on
+	// its own copy, the context only holds the copy of the last checkpoint.
+	AliyunpanRefreshState struct {
+		StartTime time.Time                  `json:"startTime"`
+		Filter    string                     `json:"filter"`
+		Drives    []string                   `json:"drives"`
+		Pending   []AliyunpanPendingFolder   `json:"pending"`
+		Folders   map[string]AliyunpanFolder `json:"folders"`
+		Items     []CacheItem                `json:"items"`
+		Listed    int                        `json:"listed"`
+		Reused    int                        `json:"reused"`
+	}
+)
+
+const (
+	aliyunpanRootFolderId = aliyunpan.DefaultRootParentFileId
+	// aliyunpanCheckpointFolders is how many folders are visited between two
+	// saves of the refresh progress.
+	aliyunpanCheckpointFolders = 100
+)
+
+// RefreshSource walks the drive folder by folder. In incremental mode only
+// folders whose updated_at changed since the last refresh are listed again,
+// the others take their files and sub folders from the snapshot.
+func (p *AliyunpanSource) RefreshSource(ctx context.Context) ([]CacheItem, error) {
+	filterKey := p.Context.Filter.Key()
+	drives := p.selectedDrives()
+	state := p.Context.Refresh.clone()
+	if state != nil && (state.Filter != filterKey || strings.Join(state.Drives, ",") != strings.Join(drives, ",")) {
+		logrus.WithFields(logrus.Fields{
+			"startTime": state.StartTime,
+		}).Info("AliyunpanRefreshSelectionChanged")
+		state = nil
+	}
+	if state == nil {
+		state = &AliyunpanRefreshState{
+			StartTime: time.Now(),
+			Filter:    filterKey,
+			Drives:    drives,
+			Folders:   make(map[string]AliyunpanFolder),
+			Items:     []CacheItem{},
+		}
+		for _, driveId := range drives {
+			state.Pending = append(state.Pending, AliyunpanPendingFolder{Id: aliyunpanRootFolderId, DriveId: driveId, Path: "/"})
+		}
+	} else {
+		logrus.WithFields(logrus.Fields{
+			"startTime": state.StartTime,
+			"pending":   len(state.Pending),
+			"folders":   len(state.Folders),
+		}).Info("AliyunpanRefreshResumed")
+	}
+
+	snapshotItems := make(map[string][]CacheItem)
+	snapshotFolders := make(map[string][]string)
+	if p.Context.Incremental && p.Context.FolderFilter == filterKey {
+		for _, item := range p.items.Items() {
+			key := aliyunpanFolderKey(item.DriveId, item.ParentId)
+			snapshotItems[key] = append(snapshotItems[key], item)
+		}
+		for key, folder := range p.Context.Folders {
+			parentKey := aliyunpanFolderKey(folder.DriveId, folder.ParentId)
+			snapshotFolders[parentKey] = append(snapshotFolders[parentKey], key)
+		}
+	}
+
+	visited := 0
+	for len(state.Pending) != 0 {
+		if err := ctx.Err(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"pending": len(state.Pending),
+				"folders": len(state.Folders),
+			}).Info("AliyunpanRefreshCanceled")
+			p.checkpoint(state)
+			return nil, err
+		}
+		folder := state.Pending[0]
+		if err := p.visitFolder(state, &folder, snapshotItems, snapshotFolders); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"driveId": folder.DriveId,
+				"path":    folder.Path,
+				"pending": len(state.Pending),
+				"errCode": err.Code,
+				"err":     err.Message,
+			}).Warn("AliyunpanRefreshInterrupted")
+			p.checkpoint(state)
+			return nil, err
+		}
+		state.Pending = state.Pending[1:]
+		visited++
+		if visited%aliyunpanCheckpointFolders == 0 {
+			p.checkpoint(state)
+		}
+	}
+
+	p.items.Replace(state.Items)
+	config.Update(func() {
+		p.Context.Folders = state.Folders
+		p.Context.FolderFilter = state.Filter
+		p.Context.Refresh = nil
+	})
+	logrus.WithFields(logrus.Fields{
+		"count":   len(state.Items),
+		"folders": len(state.Folders),
+		"listed":  state.Listed,
+		"reused":  state.Reused,
+	}).Info("AliyunpanRefreshSource")
+	return state.Items, nil
+}
+
+// checkpoint saves a copy of the refresh progress.
+func (p *AliyunpanSource) checkpoint(state *AliyunpanRefreshState) {
+	snapshot := state.clone()
+	config.Update(func() {
+		p.Context.Refresh = snapshot
+	})
+	saveSourceContext(p.Context)
+}
+
+// clone copies the state so that the refresh can go on while the copy is
+// saved. Slices are capped instead of copied, appending to the original
+// never writes to the part the copy sees.
+func (p *AliyunpanRefreshState) clone() *AliyunpanRefreshState {
+	if p == nil {
+		return nil
+	}
+	res := *p
+	res.Pending = p.Pending[:len(p.Pending):len(p.Pending)]
+	res.Items = p.Items[:len(p.Items):len(p.Items)]
+	res.Folders = make(map[string]AliyunpanFolder, len(p.Folders))
+	for k, v := range p.Folders {
+		res.Folders[k] = v
+	}
+	return &res
+}
+
+func (p *AliyunpanSource) visitFolder(state *AliyunpanRefreshState, folder *AliyunpanPendingFolder,
+	snapshotItems map[string][]CacheItem, snapshotFolders map[string][]string) *aliyunpanapi.ApiError {
+	key := aliyunpanFolderKey(folder.DriveId, folder.Id)
+	// A folder moved during the refresh may be reached twice.
+	if _, ok := state.Folders[key]; ok {
+		return nil
+	}
+	if folder.Id != aliyunpanRootFolderId && len(folder.UpdatedAt) == 0 {
+		info, err := p.client.GetFile(folder.DriveId, folder.Id)
+		if err != nil {
+			if err.Code == aliyunpanapi.NotFound {
+				return nil
+			}
+			return err
+		}
+		folder.Name = info.Name
+		folder.UpdatedAt = info.UpdatedAt
+	}
+
+	current := AliyunpanFolder{
+		Id:        folder.Id,
+		DriveId:   folder.DriveId,
+		Name:      folder.Name,
+		ParentId:  folder.ParentId,
+		UpdatedAt: folder.UpdatedAt,
+	}
+	previous, ok := p.Context.Folders[key]
+	if p.Context.Incremental && ok && folder.Id != aliyunpanRootFolderId && previous.UpdatedAt == folder.UpdatedAt {
+		state.Folders[key] = current
+		for _, item := range snapshotItems[key] {
+			item.CachedPath = path.Join(folder.Path, path.Base(item.CachedPath))
+			if p.Context.Filter.MatchFile(item.CachedPath, item.Size) {
+				state.Items = append(state.Items, item)
+			}
+		}
+		// The updated_at of the snapshot is stale, leave it empty so that
+		// the current one is looked up.
+		for _, childKey := range snapshotFolders[key] {
+			child := p.Context.Folders[childKey]
+			if !p.Context.Filter.WalkFolder(path.Join(folder.Path, child.Name)) {
+				continue
+			}
+			state.Pending = append(state.Pending, AliyunpanPendingFolder{
+				Id:       child.Id,
+				DriveId:  folder.DriveId,
+				Name:     child.Name,
+				ParentId: folder.Id,
+				Path:     path.Join(folder.Path, child.Name),
+			})
+		}
+		state.Reused++
+		return nil
+	}
+
+	entries, err := p.client.ListFiles(folder.DriveId, folder.Id)
+	if err != nil {
+		if err.Code == aliyunpanapi.NotFound {
+			return nil
+		}
+		return err
+	}
+	state.Folders[key] = current
+	for _, f := range entries {
+		filePath := path.Join(folder.Path, f.Name)
+		if f.IsFolder() {
+			if !p.Context.Filter.WalkFolder(filePath) {
+				continue
+			}
+			state.Pending = append(state.Pending, AliyunpanPendingFolder{
+				Id:        f.FileId,
+				DriveId:   folder.DriveId,
+				Name:      f.Name,
+				ParentId:  folder.Id,
+				Path:      filePath,
+				UpdatedAt: f.UpdatedAt,
+			})
+			continue
+		}
+		if !p.Context.Filter.MatchFile(filePath, f.Size) {
+			continue
+		}
+		hashContent, hexErr := hex.DecodeString(f.ContentHash)
+		if hexErr != nil || len(hashContent) == 0 {
+			continue
+		}
+		state.Items = append(state.Items, CacheItem{
+			ItemId:     f.FileId,
+			Hashes:     map[string]string{f.ContentHashName: base64.StdEncoding.EncodeToString(hashContent)},
+			CachedPath: filePath,
+			ParentId:   folder.Id,
+			Size:       f.Size,
+			DriveId:    folder.DriveId,
+		})
+	}
+	state.Listed++
+	return nil
+}
+
+// aliyunpanFolderKey identifies a folder across drives, file ids are only
+// unique within a drive and every drive has a folder named root.
+func aliyunpanFolderKey(driveId string, fileId string) string {
+	return driveId + "/" + fileId
+}
@@ -0,0 +1,123 @@
+package source
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"xxtuitui.com/filesvr/aliyunpanapi"
+)
+
+// fakeAliyunpanClient serves a folder tree, entries by parent id, and counts
+// the api calls.
+type fakeAliyunpanClient struct {
+	lock    sync.Mutex
+	entries map[string][]aliyunpanapi.File
+	listed  int
+	looked  int
+}
+
+func (p *fakeAliyunpanClient) Authorize(refreshToken string) (*aliyunpanToken, error) {
+	return &aliyunpanToken{RefreshToken: refreshToken, ExpiresIn: 3600}, nil
+}
+
+func (p *fakeAliyunpanClient) Drives() (*aliyunpanapi.UserDrives, error) {
+	return &aliyunpanapi.UserDrives{DefaultDriveId: "drive", BackupDriveId: "drive"}, nil
+}
+
+func (p *fakeAliyunpanClient) ListFiles(driveId string, parentFileId string) ([]aliyunpanapi.File, *aliyunpanapi.ApiError) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.listed++
+	return p.entries[parentFileId], nil
+}
+
+func (p *fakeAliyunpanClient) GetFile(driveId string, fileId string) (*aliyunpanapi.File, *aliyunpanapi.ApiError) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.looked++
+	for _, entries := range p.entries {
+		for _, f := range entries {
+			if f.FileId == fileId {
+				return &f, nil
+			}
+		}
+	}
+	return nil, aliyunpanapi.NewApiError(0, aliyunpanapi.NotFound, "not found")
+}
+
+func (p *fakeAliyunpanClient) GetDownloadUrl(driveId string, fileId string, expireSec int) (string, *aliyunpanapi.ApiError) {
+	return "https://example.com/" + fileId, nil
+}
+
+func (p *fakeAliyunpanClient) calls() (int, int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	listed, looked := p.listed, p.looked
+	p.listed, p.looked = 0, 0
+	return listed, looked
+}
+
+func TestAliyunpanIncrementalRefreshSkipsUnchangedSubtrees(t *testing.T) {
+	contexts := CacheSourceContextList{}
+	useTestContext(t, &contexts)
+	folder := func(id string, updatedAt string) aliyunpanapi.File {
+		return aliyunpanapi.File{FileId: id, Name: id, Type: "folder", UpdatedAt: updatedAt}
+	}
+	file := func(id string) aliyunpanapi.File {
+		return aliyunpanapi.File{FileId: id, Name: id + ".mkv", Type: "file", ContentHash: "00ff", ContentHashName: "sha1"}
+	}
+	client := &fakeAliyunpanClient{entries: map[string][]aliyunpanapi.File{
+		aliyunpanRootFolderId: {folder("movies", "1")},
+		"movies":              {folder("a", "1"), folder("b", "1")},
+		"a":                   {file("a1"), folder("a-extras", "1")},
+		"a-extras":            {file("a2")},
+		"b":                   {file("b1")},
+	}}
+	s := &AliyunpanSource{
+		client:  client,
+		Context: &AliyunpanContext{Incremental: true},
+		drives:  []string{"drive"},
+	}
+
+	refresh := func() int {
+		items, err := s.RefreshSource(context.Background())
+		if err != nil {
+			t.Fatalf("refresh: %v", err)
+		}
+		return len(items)
+	}
+	if count := refresh(); count != 3 {
+		t.Fatalf("first refresh: got %d items, want 3", count)
+	}
+	if listed, looked := client.calls(); listed != 5 || looked != 0 {
+		t.Errorf("first refresh: listed %d folders and looked up %d, want 5 and 0", listed, looked)
+	}
+
+	if count := refresh(); count != 3 {
+		t.Errorf("unchanged refresh: got %d items, want 3", count)
+	}
+	if listed, looked := client.calls(); listed != 1 || looked != 3 {
+		t.Errorf("unchanged refresh: listed %d folders and looked up %d, want only the root and 3", listed, looked)
+	}
+
+	// A file added to b bumps b only, movies and the root keep their
+	// updated_at.
+	client.lock.Lock()
+	client.entries["b"] = append(client.entries["b"], file("b2"))
+	client.entries["movies"] = []aliyunpanapi.File{folder("a", "1"), folder("b", "2")}
+	client.lock.Unlock()
+	if count := refresh(); count != 4 {
+		t.Errorf("refresh after a change: got %d items, want 4", count)
+	}
+	if listed, looked := client.calls(); listed != 2 || looked != 3 {
+		t.Errorf("refresh after a change: listed %d folders and looked up %d, want 2 and 3", listed, looked)
+	}
+	found := false
+	for _, item := range s.items.Items() {
+		found = found || item.ItemId == "b2"
+	}
+	if !found {
+		t.Error("file added to b was not picked up")
+	}
+}
@@ -0,0 +1,268 @@
+package source
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tickstep/aliyunpan-api/aliyunpan"
+	"xxtuitui.com/filesvr/aliyunpanapi"
+	"xxtuitui.com/filesvr/config"
+)
+
+type (
+	AliyunpanShareContext struct {
+		ShareId       string `json:"shareId" source:"required"`
+		SharePassword string `json:"sharePassword"`
+		// RefreshToken signs in the account that resolves download urls,
+		// Aliyunpan refuses them to anonymous visitors of a share.
+		RefreshToken    string       `json:"refreshToken" source:"required"`
+		RootFolderId    string       `json:"rootFolderId"`
+		UrlCacheTtlSec  int          `json:"urlCacheTtlSec"`
+		Filter          SourceFilter `json:"filter"`
+		LastRefreshTime time.Time    `json:"lastRefreshTime"`
+	}
+
+	AliyunpanShareSource struct {
+		Context    *AliyunpanShareContext
+		items      sourceItems
+		urls       *UrlCache
+		urlCalls   flightGroup[string]
+		tokenCalls flightGroup[struct{}]
+		web        *aliyunpanapi.WebClient
+
+		// lock guards the tokens, a renewal replaces them while requests
+		// are sent with them.
+		lock        sync.RWMutex
+		shareToken  *aliyunpanapi.ShareToken
+		tokenExpiry time.Time
+	}
+)
+
+const aliyunpanShareUrlExpireSec = 3600 * 4
+
+func init() {
+	RegisterSourceType(SourceType{
+		Name:   "AliyunpanShare",
+		Schema: SchemaOf(AliyunpanShareContext{}),
+		Capabilities: SourceCapabilities{
+			Hashes:   []string{"sha1"},
+			Redirect: true,
+		},
+		New: func() CacheSource { return &AliyunpanShareSource{} },
+	})
+}
+
+func (p *AliyunpanShareSource) Restore(context *CacheSourceContext) error {
+	sourceContext, err := DecodeContext[AliyunpanShareContext](context)
+	if err != nil {
+		return err
+	}
+	p.Context = sourceContext
+
+	if len(p.Context.ShareId) == 0 {
+		return errors.New("EmptyShareId")
+	}
+	if len(p.Context.RefreshToken) == 0 {
+		return errors.New("EmptyRefreshToken")
+	}
+	if len(p.Context.RootFolderId) == 0 {
+		p.Context.RootFolderId = aliyunpan.DefaultRootParentFileId
+	}
+	if p.Context.UrlCacheTtlSec == 0 {
+		p.Context.UrlCacheTtlSec = aliyunpanShareUrlExpireSec
+	}
+	return rotateToken(p.Context, p.Init)
+}
+
+func (p *AliyunpanShareSource) Init() error {
+	if p.urls == nil {
+		p.urls = NewUrlCache(time.Duration(p.Context.UrlCacheTtlSec) * time.Second)
+	}
+	if p.web == nil {
+		p.web = aliyunpanapi.NewWebClient("")
+	}
+	if err := p.updateToken(); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"shareId":          p.Context.ShareId,
+		"shareTokenExpiry": p.TokenExpiry(),
+	}).Info("AliyunpanShareSourceInitialized")
+	return nil
+}
+
+// updateToken renews both the access token of the account and the share
+// token.
+func (p *AliyunpanShareSource) updateToken() error {
+	webToken, err := aliyunpan.GetAccessTokenFromRefreshToken(p.Context.RefreshToken)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	config.Update(func() {
+		p.Context.RefreshToken = webToken.RefreshToken
+		p.Context.LastRefreshTime = now
+	})
+	p.web.SetToken(webToken.AccessToken)
+	p.lock.Lock()
+	p.tokenExpiry = now.Add(time.Duration(webToken.ExpiresIn) * time.Second)
+	p.lock.Unlock()
+
+	shareToken, apiErr := p.web.GetShareToken(p.Context.ShareId, p.Context.SharePassword)
+	if apiErr != nil {
+		return apiErr
+	}
+	p.lock.Lock()
+	p.shareToken = shareToken
+	p.lock.Unlock()
+	return nil
+}
+
+// currentShareToken returns the share token requests are sent with.
+func (p *AliyunpanShareSource) currentShareToken() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.shareToken.ShareToken
+}
+
+// TokenExpiry returns when the first of the access token and the share
+// token expires.
+func (p *AliyunpanShareSource) TokenExpiry() time.Time {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.shareToken != nil && p.shareToken.ExpiresAt.Before(p.tokenExpiry) {
+		return p.shareToken.ExpiresAt
+	}
+	return p.tokenExpiry
+}
+
+// RefreshToken renews the web access token and then the share token, which
+// is requested with it, and saves the rotated refresh token.
+func (p *AliyunpanShareSource) RefreshToken() error {
+	_, err := p.tokenCalls.Do("", func() (struct{}, error) {
+		return struct{}{}, rotateToken(p.Context, p.updateToken)
+	})
+	return err
+}
+
+func (p *AliyunpanShareSource) MappingFile(reqFileUrl string, localName string, hashes map[string]string) error {
+	_, err := p.items.Match(reqFileUrl, hashes)
+	return err
+}
+
+func (p *AliyunpanShareSource) GetUrl(reqFileUrl string) (string, error) {
+	item, err := p.items.Lookup(reqFileUrl)
+	if err != nil {
+		return "", err
+	}
+	if url, ok := p.urls.Get(item.ItemId); ok {
+		return url, nil
+	}
+	return p.urlCalls.Do(item.ItemId, func() (string, error) {
+		return p.downloadUrl(reqFileUrl, item.ItemId)
+	})
+}
+
+func (p *AliyunpanShareSource) downloadUrl(reqFileUrl string, itemId string) (string, error) {
+	res, err := p.web.GetShareDownloadUrl(p.currentShareToken(), p.Context.ShareId, itemId, aliyunpanShareUrlExpireSec)
+	if err != nil && (err.Code == aliyunpanapi.AccessTokenInvalid || err.Code == aliyunpanapi.ShareLinkTokenInvalid) {
+		logrus.WithFields(logrus.Fields{
+			"errCode": err.Code,
+		}).Info("AliyunpanShareTokenExpired")
+		if err := p.RefreshToken(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"reqUrl": reqFileUrl,
+				"err":    err,
+			}).Info("AliyunpanShareGetUrlFailed")
+			return "", err
+		}
+		res, err = p.web.GetShareDownloadUrl(p.currentShareToken(), p.Context.ShareId, itemId, aliyunpanShareUrlExpireSec)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"reqUrl":  reqFileUrl,
+			"errCode": err.Code,
+			"err":     err.Message,
+		}).Info("AliyunpanShareGetUrlFailed")
+		return "", err
+	}
+	p.urls.Put(itemId, res.DownloadUrl)
+	return res.DownloadUrl, nil
+}
+
+// RefreshSource walks the share from RootFolderId, skipping the folders the
+// filter excludes.
+func (p *AliyunpanShareSource) RefreshSource(ctx context.Context) ([]CacheItem, error) {
+	type pendingFolder struct {
+		id   string
+		path string
+	}
+	pending := []pendingFolder{{id: p.Context.RootFolderId, path: "/"}}
+	res := []CacheItem{}
+	for len(pending) != 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		folder := pending[0]
+		pending = pending[1:]
+		files, err := p.web.ListShareFiles(p.currentShareToken(), p.Context.ShareId, folder.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			filePath := path.Join(folder.path, f.Name)
+			if f.IsFolder() {
+				if p.Context.Filter.WalkFolder(filePath) {
+					pending = append(pending, pendingFolder{id: f.FileId, path: filePath})
+				}
+				continue
+			}
+			if !p.Context.Filter.MatchFile(filePath, f.Size) {
+				continue
+			}
+			hashContent, err := hex.DecodeString(f.ContentHash)
+			if err != nil || len(hashContent) == 0 {
+				continue
+			}
+			hashName := f.ContentHashName
+			if len(hashName) == 0 {
+				hashName = "sha1"
+			}
+			res = append(res, CacheItem{
+				ItemId:     f.FileId,
+				Hashes:     map[string]string{hashName: base64.StdEncoding.EncodeToString(hashContent)},
+				CachedPath: filePath,
+				ParentId:   folder.id,
+				Size:       f.Size,
+			})
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"shareId": p.Context.ShareId,
+		"count":   len(res),
+	}).Info("AliyunpanShareRefreshSource")
+	p.items.Replace(res)
+	return res, nil
+}
+
+func (p *AliyunpanShareSource) RestoreSource(items *[]CacheItem) {
+	p.items.Replace(*items)
+}
+
+func (p *AliyunpanShareSource) MappedFileSize() int { return p.items.MappedLen() }
+
+func (p *AliyunpanShareSource) CachedFileSize() int { return p.items.Len() }
+
+func (p *AliyunpanShareSource) cachedItems() *sourceItems { return &p.items }
+
+func (p *AliyunpanShareSource) cachedUrls() *UrlCache { return p.urls }
+
+func (p *AliyunpanShareSource) HasMapping(reqUrl string) bool {
+	return p.items.HasMapping(reqUrl)
+}
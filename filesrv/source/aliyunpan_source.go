@@ -1,161 +1,337 @@
 package source
 
 import (
-	"encoding/base64"
-	"encoding/hex"
 	"errors"
+	"sync"
 	"time"
 
-	"github.com/mitchellh/mapstructure"
 	"github.com/sirupsen/logrus"
-	"github.com/tickstep/aliyunpan-api/aliyunpan"
-	"github.com/tickstep/aliyunpan-api/aliyunpan/apierror"
+	"xxtuitui.com/filesvr/aliyunpanapi"
 	"xxtuitui.com/filesvr/config"
 )
 
 type (
 	AliyunpanContext struct {
-		RefreshToken    string      `json:"refreshToken"`
-		DriveId         string      `json:"driveId"`
-		LastRefreshTime time.Time   `json:"lastRefreshTime"`
-		CachedItems     []CacheItem `json:"cachedItems"`
+		RefreshToken string   `json:"refreshToken" source:"required"`
+		DriveId      string   `json:"driveId"`
+		Drives       []string `json:"drives"`
+		// ClientMode selects the web api or the open platform, the refresh
+		// tokens of both are not interchangeable.
+		ClientMode string `json:"clientMode"`
+		// AppId and AppSecret identify the open platform application.
+		AppId     string `json:"appId"`
+		AppSecret string `json:"appSecret"`
+		// AuthorizationCode is exchanged for the first open platform refresh
+		// token, it is cleared once used.
+		AuthorizationCode string       `json:"authorizationCode"`
+		RedirectUri       string       `json:"redirectUri"`
+		OpenApiUrl        string       `json:"openApiUrl"`
+		UrlCacheTtlSec    int          `json:"urlCacheTtlSec"`
+		Incremental       bool         `json:"incremental"`
+		Filter            SourceFilter `json:"filter"`
+		LastRefreshTime   time.Time    `json:"lastRefreshTime"`
+		// Folders is the folder snapshot of the last completed refresh.
+		Folders map[string]AliyunpanFolder `json:"folders,omitempty"`
+		// FolderFilter is the key of the filter the snapshot was taken with.
+		FolderFilter string `json:"folderFilter,omitempty"`
+		// Refresh holds the progress of an interrupted refresh.
+		Refresh *AliyunpanRefreshState `json:"refresh,omitempty"`
 	}
 
 	AliyunpanSource struct {
-		client  *aliyunpan.PanClient
-		mapping map[string]*CacheItem
-		Context *AliyunpanContext
+		client     aliyunpanClient
+		items      sourceItems
+		urls       *UrlCache
+		urlCalls   flightGroup[string]
+		tokenCalls flightGroup[struct{}]
+		Context    *AliyunpanContext
+
+		// lock guards drives and tokenExpiry, a login selects the drives
+		// again and a renewal replaces the token while requests are served.
+		lock        sync.RWMutex
+		drives      []string
+		tokenExpiry time.Time
+		// renewing keeps a login from rotating the tokens while they are
+		// renewed.
+		renewing sync.Mutex
 	}
 )
 
+// Roles accepted in AliyunpanContext.Drives, any other value is taken as a
+// drive id.
+const (
+	AliyunpanDriveBackup   = "backup"
+	AliyunpanDriveResource = "resource"
+	AliyunpanDriveAlbum    = "album"
+)
+
+// Values of AliyunpanContext.ClientMode.
+const (
+	AliyunpanClientWeb     = "web"
+	AliyunpanClientOpenApi = "openApi"
+
+	aliyunpanUrlExpireSec = 3600 * 4
+)
+
+func init() {
+	RegisterSourceType(SourceType{
+		Name:   "Aliyunpan",
+		Schema: SchemaOf(AliyunpanContext{}),
+		Capabilities: SourceCapabilities{
+			Hashes:   []string{"sha1"},
+			Redirect: true,
+		},
+		New: func() CacheSource { return &AliyunpanSource{} },
+	})
+}
+
 func (p *AliyunpanSource) Restore(context *CacheSourceContext) error {
-	var sourceContext AliyunpanContext
-	mapstructure.Decode(context.Context, &sourceContext)
-	context.Context = &sourceContext
-	p.Context = &sourceContext
+	sourceContext, err := DecodeContext[AliyunpanContext](context)
+	if err != nil {
+		return err
+	}
+	p.Context = sourceContext
 
-	if len(p.Context.RefreshToken) == 0 {
-		return errors.New("EmptyRefreshToken")
+	if len(p.Context.ClientMode) == 0 {
+		p.Context.ClientMode = AliyunpanClientWeb
+	}
+	if p.Context.UrlCacheTtlSec == 0 {
+		p.Context.UrlCacheTtlSec = aliyunpanUrlExpireSec
 	}
-	return p.Init(p.Context.RefreshToken)
+	var open *aliyunpanapi.OpenClient
+	switch p.Context.ClientMode {
+	case AliyunpanClientWeb:
+		p.client = &aliyunpanWebClient{}
+		if len(p.Context.RefreshToken) == 0 {
+			// The source is restored again once the QR code login succeeds.
+			if err := AliyunpanLogins.Start(context.Name, context); err != nil {
+				return err
+			}
+			return errors.New("EmptyRefreshToken")
+		}
+	case AliyunpanClientOpenApi:
+		if len(p.Context.AppId) == 0 || len(p.Context.AppSecret) == 0 {
+			return errors.New("InvalidContext")
+		}
+		open = aliyunpanapi.NewOpenClient(p.Context.OpenApiUrl, p.Context.AppId, p.Context.AppSecret)
+		p.client = &aliyunpanOpenClient{open: open}
+	default:
+		return errors.New("ClientModeNotSupported")
+	}
+	return rotateToken(p.Context, func() error {
+		if open != nil && len(p.Context.RefreshToken) == 0 {
+			if err := p.authorizeOpenApi(open); err != nil {
+				return err
+			}
+		}
+		return p.Init(p.Context.RefreshToken)
+	})
+}
+
+// authorizeOpenApi exchanges the authorization code for the first refresh
+// token, or logs the page that grants one.
+func (p *AliyunpanSource) authorizeOpenApi(open *aliyunpanapi.OpenClient) error {
+	if len(p.Context.AuthorizationCode) == 0 {
+		logrus.WithFields(logrus.Fields{
+			"authorizeUrl": open.AuthorizeUrl(p.Context.RedirectUri),
+		}).Warn("AliyunpanOpenApiAuthorizationRequired")
+		return errors.New("EmptyAuthorizationCode")
+	}
+	token, err := open.GetTokenByCode(p.Context.AuthorizationCode)
+	if err != nil {
+		return err
+	}
+	p.Context.RefreshToken = token.RefreshToken
+	p.Context.AuthorizationCode = ""
+	return nil
 }
 
 func (p *AliyunpanSource) Init(refreshToken string) error {
-	if p.mapping == nil {
-		p.mapping = make(map[string]*CacheItem)
+	if p.urls == nil {
+		p.urls = NewUrlCache(time.Duration(p.Context.UrlCacheTtlSec) * time.Second)
 	}
-	webToken, err := aliyunpan.GetAccessTokenFromRefreshToken(refreshToken)
+	if p.client == nil {
+		p.client = &aliyunpanWebClient{}
+	}
+	if err := p.updateToken(refreshToken); err != nil {
+		return err
+	}
+	userDrives, err := p.client.Drives()
 	if err != nil {
 		return err
 	}
-	p.Context.RefreshToken = webToken.RefreshToken
-	p.client = aliyunpan.NewPanClient(*webToken, aliyunpan.AppLoginToken{})
-	user, err := p.client.GetUserInfo()
+	drives, err := p.selectDrives(userDrives)
 	if err != nil {
 		return err
 	}
-	p.Context.DriveId = user.FileDriveId
-	p.Context.LastRefreshTime = time.Now()
+	p.lock.Lock()
+	p.drives = drives
+	p.lock.Unlock()
+	config.Update(func() {
+		p.Context.DriveId = drives[0]
+	})
 	logrus.WithFields(logrus.Fields{
-		"originRefreshToken": refreshToken,
-		"latestRefreshToken": p.Context.RefreshToken,
-		"driveId":            p.Context.DriveId,
+		"clientMode": p.Context.ClientMode,
+		"driveId":    drives[0],
+		"drives":     drives,
 	}).Info("AliyunSourceInitialized")
 	return nil
 }
 
+// selectedDrives returns the drives the source lists, the first one holds
+// the items that don't name their drive.
+func (p *AliyunpanSource) selectedDrives() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.drives
+}
+
+// selectDrives resolves the roles and ids of AliyunpanContext.Drives, the
+// backup drive is used when none is given.
+func (p *AliyunpanSource) selectDrives(userDrives *aliyunpanapi.UserDrives) ([]string, error) {
+	selected := p.Context.Drives
+	if len(selected) == 0 {
+		selected = []string{AliyunpanDriveBackup}
+	}
+	var res []string
+	for _, name := range selected {
+		driveId := name
+		switch name {
+		case AliyunpanDriveBackup:
+			driveId = userDrives.BackupDriveId
+		case AliyunpanDriveAlbum:
+			driveId = userDrives.AlbumDriveId
+		case AliyunpanDriveResource:
+			driveId = userDrives.ResourceDriveId
+		}
+		if len(driveId) == 0 {
+			return nil, errors.New("DriveNotFound: " + name)
+		}
+		duplicated := false
+		for _, id := range res {
+			duplicated = duplicated || id == driveId
+		}
+		if !duplicated {
+			res = append(res, driveId)
+		}
+	}
+	return res, nil
+}
+
 func (p *AliyunpanSource) updateToken(refreshToken string) error {
-	webToken, err := aliyunpan.GetAccessTokenFromRefreshToken(refreshToken)
+	token, err := p.client.Authorize(refreshToken)
 	if err != nil {
 		return err
 	}
-	p.Context.RefreshToken = webToken.RefreshToken
-	p.client.UpdateToken(*webToken)
-	logrus.WithFields(logrus.Fields{
-		"originToken":  refreshToken,
-		"updatedToken": p.Context.RefreshToken,
+	now := time.Now()
+	config.Update(func() {
+		p.Context.RefreshToken = token.RefreshToken
+		p.Context.LastRefreshTime = now
 	})
+	expiry := now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	p.lock.Lock()
+	p.tokenExpiry = expiry
+	p.lock.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"expiresAt": expiry,
+	}).Info("AliyunpanTokenUpdated")
 	return nil
 }
 
+func (p *AliyunpanSource) TokenExpiry() time.Time {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.tokenExpiry
+}
+
+// RefreshToken renews the access token and saves the rotated refresh token,
+// it waits for a QR code login in progress to finish first.
+func (p *AliyunpanSource) RefreshToken() error {
+	_, err := p.tokenCalls.Do("", func() (struct{}, error) {
+		p.renewing.Lock()
+		defer p.renewing.Unlock()
+		return struct{}{}, rotateToken(p.Context, func() error {
+			return p.updateToken(p.Context.RefreshToken)
+		})
+	})
+	return err
+}
+
+// login initializes the running source again with the refresh token of a
+// QR code login, the account may have other drives.
+func (p *AliyunpanSource) login(refreshToken string) error {
+	p.renewing.Lock()
+	defer p.renewing.Unlock()
+	return rotateToken(p.Context, func() error {
+		return p.Init(refreshToken)
+	})
+}
+
 func (p *AliyunpanSource) MappingFile(reqFileUrl string, localName string, hashes map[string]string) error {
-	for _, f := range p.Context.CachedItems {
-		if !f.IsHashEqual(hashes) {
-			continue
-		}
-		p.mapping[reqFileUrl] = &f
-		return nil
-	}
-	return errors.New("CachedFileNotFound")
+	_, err := p.items.Match(reqFileUrl, hashes)
+	return err
 }
 
 func (p *AliyunpanSource) GetUrl(reqFileUrl string) (string, error) {
-	var item *CacheItem
-	if value, ok := p.mapping[reqFileUrl]; ok {
-		item = value
+	item, err := p.items.Lookup(reqFileUrl)
+	if err != nil {
+		return "", err
+	}
+	driveId := item.DriveId
+	if len(driveId) == 0 {
+		driveId = p.selectedDrives()[0]
 	}
-	query := aliyunpan.GetFileDownloadUrlParam{
-		DriveId:   p.Context.DriveId,
-		FileId:    item.ItemId,
-		ExpireSec: 3600 * 4,
+	cacheKey := driveId + "/" + item.ItemId
+	if url, ok := p.urls.Get(cacheKey); ok {
+		return url, nil
 	}
-	res, err := p.client.GetFileDownloadUrl(&query)
+	// Players open several connections at once, they share one lookup.
+	return p.urlCalls.Do(cacheKey, func() (string, error) {
+		url, err := p.downloadUrl(reqFileUrl, driveId, item.ItemId)
+		if err != nil {
+			return "", err
+		}
+		p.urls.Put(cacheKey, url)
+		return url, nil
+	})
+}
+
+func (p *AliyunpanSource) downloadUrl(reqFileUrl string, driveId string, itemId string) (string, error) {
+	url, err := p.client.GetDownloadUrl(driveId, itemId, aliyunpanUrlExpireSec)
 	if err != nil {
-		if err.ErrCode() == apierror.ApiCodeAccessTokenInvalid {
+		if err.Code == aliyunpanapi.AccessTokenInvalid {
 			logrus.Info("AliyunpanApiTokenExpired")
-			if err := p.Init(p.Context.RefreshToken); err == nil {
-				config.SaveContext()
+			if err := p.RefreshToken(); err == nil {
 				logrus.WithFields(logrus.Fields{
 					"reqUrl": reqFileUrl,
 				}).Info("AliyunpanRefreshTokenRetry")
-				if res, err := p.client.GetFileDownloadUrl(&query); err == nil {
-					return res.Url, nil
+				if url, err := p.client.GetDownloadUrl(driveId, itemId, aliyunpanUrlExpireSec); err == nil {
+					return url, nil
 				}
 			}
 		}
 		logrus.WithFields(logrus.Fields{
 			"reqUrl":  reqFileUrl,
-			"errCode": err.ErrCode(),
-			"err":     err.Error(),
+			"errCode": err.Code,
+			"err":     err.Message,
 		}).Info("AliyunpanGetUrlFailed")
 		return "", err
 	}
-	return res.Url, nil
-}
-
-func (p *AliyunpanSource) RefreshSource() ([]CacheItem, error) {
-	nodes := p.client.FilesDirectoriesRecurseList(p.Context.DriveId, "/", nil)
-	files := []CacheItem{}
-	for _, f := range nodes {
-		if !f.IsFile() {
-			continue
-		}
-		hashContent, err := hex.DecodeString(f.ContentHash)
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, CacheItem{
-			ItemId:     f.FileId,
-			Hashes:     map[string]string{f.ContentHashName: base64.StdEncoding.EncodeToString(hashContent)},
-			CachedPath: f.Path,
-		})
-	}
-	logrus.WithFields(logrus.Fields{
-		"count": len(files),
-	}).Info("AliyunpanRefreshSource")
-	p.Context.CachedItems = files
-	return files, nil
+	return url, nil
 }
 
 func (p *AliyunpanSource) RestoreSource(items *[]CacheItem) {
-	p.Context.CachedItems = *items
+	p.items.Replace(*items)
 }
 
-func (p *AliyunpanSource) MappedFileSize() int { return len(p.mapping) }
+func (p *AliyunpanSource) MappedFileSize() int { return p.items.MappedLen() }
+
+func (p *AliyunpanSource) CachedFileSize() int { return p.items.Len() }
+
+func (p *AliyunpanSource) cachedItems() *sourceItems { return &p.items }
 
-func (p *AliyunpanSource) CachedFileSize() int { return len(p.Context.CachedItems) }
+func (p *AliyunpanSource) cachedUrls() *UrlCache { return p.urls }
 
 func (p *AliyunpanSource) HasMapping(reqUrl string) bool {
-	_, ok := p.mapping[reqUrl]
-	return ok
+	return p.items.HasMapping(reqUrl)
 }
@@ -1,20 +1,59 @@
 package source
 
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
 type CacheItem struct {
 	ItemId     string            `json:"itemId"`
 	Hashes     map[string]string `json:"hashes"`
 	CachedPath string            `json:"cachedPath"`
+	ParentId   string            `json:"parentId,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	DriveId    string            `json:"driveId,omitempty"`
 }
 
+// IsHashEqual reports whether every hash of the item is among hashes. Hashes
+// are compared in their normalized form, see hashKey.
 func (p *CacheItem) IsHashEqual(hashes map[string]string) bool {
-	if len(p.Hashes) == 0 || len(hashes) == 0 {
+	return p.matchKeys(hashKeys(hashes))
+}
+
+func (p *CacheItem) matchKeys(keys map[string]bool) bool {
+	if len(p.Hashes) == 0 || len(keys) == 0 {
 		return false
 	}
 	for k, v := range p.Hashes {
-		if value, ok := hashes[k]; ok && value == v {
-			continue
+		if !keys[hashKey(k, v)] {
+			return false
 		}
-		return false
 	}
 	return true
 }
+
+func hashKeys(hashes map[string]string) map[string]bool {
+	res := make(map[string]bool, len(hashes))
+	for k, v := range hashes {
+		res[hashKey(k, v)] = true
+	}
+	return res
+}
+
+// hashKey identifies a digest independently of how it is written: the
+// algorithm in lower case without dashes, so SHA-1 and sha1 are the same,
+// and the digest as standard base64. Digests written in hex, as some
+// backends report them, are converted.
+func hashKey(algorithm string, digest string) string {
+	algorithm = strings.ReplaceAll(strings.ToLower(algorithm), "-", "")
+	if len(digest)%2 == 0 {
+		if content, err := hex.DecodeString(digest); err == nil && len(content) != 0 {
+			return algorithm + ":" + base64.StdEncoding.EncodeToString(content)
+		}
+	}
+	if content, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(digest, "=")); err == nil {
+		return algorithm + ":" + base64.StdEncoding.EncodeToString(content)
+	}
+	return algorithm + ":" + digest
+}
@@ -1,14 +1,18 @@
 package source
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
 
-	"github.com/mitchellh/mapstructure"
 	"github.com/sirupsen/logrus"
 	"xxtuitui.com/filesvr/config"
+	"xxtuitui.com/filesvr/state"
 )
 
 type (
@@ -16,6 +20,10 @@ type (
 		Name    string      `json:"name"`
 		Type    string      `json:"type"`
 		Context interface{} `json:"context"`
+
+		// RefreshIntervalSec overrides the refresh interval of the app for
+		// this source, a negative value turns scheduled refreshes off.
+		RefreshIntervalSec int `json:"refreshIntervalSec,omitempty"`
 	}
 
 	CacheSourceContextList = []CacheSourceContext
@@ -23,7 +31,9 @@ type (
 	CacheSource interface {
 		GetUrl(reqFileUrl string) (string, error)
 		MappingFile(reqFileUrl string, localName string, hash map[string]string) error
-		RefreshSource() ([]CacheItem, error)
+		// RefreshSource lists the items of the source again, it stops early
+		// with an error once ctx is canceled.
+		RefreshSource(ctx context.Context) ([]CacheItem, error)
 		RestoreSource(items *[]CacheItem)
 		CachedFileSize() int
 		MappedFileSize() int
@@ -31,8 +41,30 @@ type (
 		Restore(context *CacheSourceContext) error
 	}
 
+	// RelaySource is implemented by sources that may ask for their urls to
+	// be streamed through filesrv instead of redirected to.
+	RelaySource interface {
+		PreferRelay() bool
+	}
+
+	// RelayHeaderSource is implemented by sources whose urls are relayed
+	// with headers filesrv adds, such as credentials. Credentials go into
+	// these headers and never into a url, urls reach clients and the log.
+	RelayHeaderSource interface {
+		RelayHeader() http.Header
+	}
+
+	// SourcesManager is safe for concurrent use. Refreshes of one source are
+	// serialized, a source never runs two refreshes at once.
 	SourcesManager struct {
-		sources map[string]CacheSource
+		lock       sync.RWMutex
+		sources    map[string]CacheSource
+		types      map[string]*SourceType
+		refreshing map[string]*sync.Mutex
+		// running cancels the refresh a source is running, status holds
+		// the last refresh of every source.
+		running map[string]context.CancelFunc
+		status  map[string]*RefreshStatus
 	}
 )
 
@@ -40,9 +72,19 @@ var Manager SourcesManager
 
 func RestoreFromContext(context *config.AppContext) {
 	var contextList CacheSourceContextList
-	mapstructure.Decode(context.Sources, &contextList)
+	if err := decodeJsonMap(context.Sources, &contextList); err != nil {
+		logrus.WithField("err", err).Error("DecodeSourcesFailed")
+		return
+	}
 	context.Sources = &contextList
 
+	if Mappings == nil && config.State != nil {
+		Mappings = NewMappingStore(config.State)
+	}
+	if shared, ok := config.State.(state.Shared); ok && Leader == nil {
+		Leader = NewElection(shared, ReplicaId())
+		Leader.Start()
+	}
 	for i := range contextList {
 		sourceContext := &contextList[i]
 		if err := Manager.Restore(sourceContext); err != nil {
@@ -53,60 +95,99 @@ func RestoreFromContext(context *config.AppContext) {
 			}).Error("RestoreSourceFailed")
 			continue
 		}
-		if err := config.SaveContext(); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"contextFilename": config.App.ContextFile,
-				"err":             err,
-			}).Error("SaveContextFailed")
-			continue
-		}
+		saveSourceContext(sourceContext.Context)
 	}
+	Tokens.Start()
+	Refreshes.Start()
 }
 
 func (p *SourcesManager) Restore(context *CacheSourceContext) error {
 	if p.HasSource(context.Name) {
 		return errors.New("SourceAlreadyExists")
 	}
-	if context.Type == "Aliyunpan" {
-		p.RegisterSource(context.Name, &AliyunpanSource{})
-	} else if context.Type == "OneDriveForBusiness" {
-		p.RegisterSource(context.Name, &OneDriveSource{})
-	} else {
+	sourceType, ok := LookupSourceType(context.Type)
+	if !ok {
 		return errors.New("SourceTypeNotSupported")
 	}
-	source := p.GetSource(context.Name)
+	source := sourceType.New()
 	if err := source.Restore(context); err != nil {
 		return err
 	}
+	if err := p.add(context.Name, source, sourceType); err != nil {
+		return err
+	}
+	if ts, ok := source.(TokenSource); ok {
+		Tokens.Register(context.Name, ts)
+	}
+	if s, ok := source.(itemSource); ok && config.State != nil {
+		if err := s.cachedItems().attach(context.Name, config.State, Mappings); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"sourceName": context.Name,
+				"err":        err,
+			}).Warn("LoadItemsFailed")
+		}
+	}
+	if s, ok := source.(urlSource); ok && s.cachedUrls() != nil {
+		if shared, ok := config.State.(state.Shared); ok {
+			s.cachedUrls().share(shared, context.Name)
+		}
+	}
+	p.restoreStatus(context.Name)
 	if source.CachedFileSize() == 0 {
-		if _, err := source.RefreshSource(); err != nil {
+		if _, err := p.Refresh(context.Name); err != nil {
 			return err
 		}
 	}
+	if interval := refreshInterval(context); interval > 0 {
+		Refreshes.Register(context.Name, interval, p.RefreshStatus(context.Name).LastRun)
+	}
 	return nil
 }
 
-func (p *SourcesManager) RefreshSource() {
-	res := make(map[string][]CacheItem)
-	for k, cs := range p.sources {
-		items, err := cs.RefreshSource()
-		if err != nil {
-			fmt.Printf("err: %v\n", err)
-			continue
-		}
-		res[k] = items
-		logrus.New().WithFields(logrus.Fields{
-			"sourceName": k,
-			"count":      len(items),
-		}).Info("SourceRefreshed")
+// Refresh runs RefreshSource of the named source, waiting for a refresh of
+// the same source that is already running, and records its status. The
+// refresh stops early once it is canceled with Cancel. A replica that isn't
+// the leader takes over the items the leader stored instead.
+func (p *SourcesManager) Refresh(sourceName string) ([]CacheItem, error) {
+	p.lock.RLock()
+	source, ok := p.sources[sourceName]
+	refreshing := p.refreshing[sourceName]
+	p.lock.RUnlock()
+	if !ok {
+		return nil, errors.New("SourceNotFound")
 	}
+	refreshing.Lock()
+	defer refreshing.Unlock()
 
-	content, err := json.MarshalIndent(res, "", "  ")
-	if err != nil {
-		fmt.Printf("err: %v\n", err)
-		return
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	p.begin(sourceName, cancel)
+	var (
+		items    []CacheItem
+		err      error
+		reloaded bool
+	)
+	if s, ok := source.(itemSource); ok && !isLeader() {
+		items, err = s.cachedItems().reload()
+		reloaded = true
+	} else {
+		items, err = source.RefreshSource(ctx)
+	}
+	// The api clients wrap the cancellation in their own errors.
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	p.finish(sourceName, start, len(items), !reloaded, err)
+	return items, err
+}
+
+// RefreshSource refreshes every source in turn, failures are logged and
+// recorded in the status of the source.
+func (p *SourcesManager) RefreshSource() {
+	for k := range p.snapshot() {
+		p.Refresh(k)
 	}
-	ioutil.WriteFile("sources.json", content, 0666)
 }
 
 func (p *SourcesManager) RestoreSource(filename string) {
@@ -121,7 +202,7 @@ func (p *SourcesManager) RestoreSource(filename string) {
 		return
 	}
 
-	for k, cs := range p.sources {
+	for k, cs := range p.snapshot() {
 		if config, ok := files[k]; ok {
 			cs.RestoreSource(&config)
 		}
@@ -130,7 +211,7 @@ func (p *SourcesManager) RestoreSource(filename string) {
 }
 
 func (p *SourcesManager) MappingFile(reqFileUrl string, localName string, hashes map[string]string) error {
-	for _, cs := range p.sources {
+	for _, cs := range p.snapshot() {
 		if err := cs.MappingFile(reqFileUrl, localName, hashes); err != nil {
 			return err
 		}
@@ -139,7 +220,7 @@ func (p *SourcesManager) MappingFile(reqFileUrl string, localName string, hashes
 }
 
 func (p *SourcesManager) HasMapping(reqFileUrl string) bool {
-	for _, cs := range p.sources {
+	for _, cs := range p.snapshot() {
 		if h := cs.HasMapping(reqFileUrl); !h {
 			return false
 		}
@@ -148,13 +229,64 @@ func (p *SourcesManager) HasMapping(reqFileUrl string) bool {
 }
 
 func (p *SourcesManager) RegisterSource(sourceName string, s CacheSource) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.register(sourceName, s)
+}
+
+// add registers a restored source unless a source of the same name was
+// registered while it was being restored.
+func (p *SourcesManager) add(sourceName string, s CacheSource, sourceType *SourceType) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.sources[sourceName]; ok {
+		return errors.New("SourceAlreadyExists")
+	}
+	p.register(sourceName, s)
+	p.types[sourceName] = sourceType
+	return nil
+}
+
+func (p *SourcesManager) register(sourceName string, s CacheSource) {
 	if p.sources == nil {
 		p.sources = make(map[string]CacheSource)
+		p.types = make(map[string]*SourceType)
+		p.refreshing = make(map[string]*sync.Mutex)
+		p.running = make(map[string]context.CancelFunc)
+		p.status = make(map[string]*RefreshStatus)
 	}
 	p.sources[sourceName] = s
+	if _, ok := p.refreshing[sourceName]; !ok {
+		p.refreshing[sourceName] = &sync.Mutex{}
+	}
+}
+
+// snapshot copies the registered sources, so callers can go through them
+// without holding the lock while a source is working.
+func (p *SourcesManager) snapshot() map[string]CacheSource {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	res := make(map[string]CacheSource, len(p.sources))
+	for k, v := range p.sources {
+		res[k] = v
+	}
+	return res
+}
+
+// GetSourceType returns the registration the named source was restored from,
+// or nil for sources registered directly.
+func (p *SourcesManager) GetSourceType(sourceName string) *SourceType {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if v, ok := p.types[sourceName]; ok {
+		return v
+	}
+	return nil
 }
 
 func (p *SourcesManager) GetSource(sourceName string) CacheSource {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
 	if v, ok := p.sources[sourceName]; ok {
 		return v
 	}
@@ -162,6 +294,8 @@ func (p *SourcesManager) GetSource(sourceName string) CacheSource {
 }
 
 func (p *SourcesManager) HasSource(sourceName string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
 	_, ok := p.sources[sourceName]
 	return ok
 }
@@ -0,0 +1,489 @@
+package source
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"xxtuitui.com/filesvr/config"
+	"xxtuitui.com/filesvr/state"
+)
+
+const (
+	testObjectCount = 50
+	testWorkers     = 8
+	testRounds      = 200
+)
+
+// testObjectHash is the md5 of object i as S3Source stores it.
+func testObjectHash(i int) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("object-%d", i)))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// newTestBucket serves a path style ListObjectsV2 listing with the objects
+// from..from+testObjectCount, from advances on every listing so refreshes
+// swap part of the item set. Object testObjectCount is in every listing.
+func newTestBucket(t *testing.T) *httptest.Server {
+	var listings int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from := 1 + int(atomic.AddInt64(&listings, 1))%(testObjectCount-1)
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, "<ListBucketResult><Name>bucket</Name>")
+		for i := from; i < from+testObjectCount; i++ {
+			sum := md5.Sum([]byte(fmt.Sprintf("object-%d", i)))
+			fmt.Fprintf(w, "<Contents><Key>object-%d</Key><ETag>\"%s\"</ETag><Size>1</Size></Contents>",
+				i, hex.EncodeToString(sum[:]))
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// useTestContext opens a state store in a temporary directory, so the
+// context can be saved while the sources change.
+func useTestContext(t *testing.T, contexts *CacheSourceContextList) {
+	dir := t.TempDir()
+	store, err := state.OpenJsonStore(filepath.Join(dir, "context.state"))
+	if err != nil {
+		t.Fatalf("open state store: %v", err)
+	}
+	previous, previousState := config.App, config.State
+	config.App = config.AppContext{
+		ContextFile: filepath.Join(dir, "context.json"),
+		Sources:     contexts,
+	}
+	config.State = store
+	t.Cleanup(func() {
+		config.App, config.State = previous, previousState
+		store.Close()
+	})
+}
+
+func newTestManager(t *testing.T, names ...string) *SourcesManager {
+	server := newTestBucket(t)
+	manager := &SourcesManager{}
+	contexts := make(CacheSourceContextList, 0, len(names))
+	for _, name := range names {
+		contexts = append(contexts, CacheSourceContext{
+			Name: name,
+			Type: "S3",
+			Context: map[string]interface{}{
+				"endpoint":        server.URL,
+				"bucket":          "bucket",
+				"pathStyle":       true,
+				"accessKeyId":     "key",
+				"secretAccessKey": "secret",
+			},
+		})
+	}
+	useTestContext(t, &contexts)
+	for i := range contexts {
+		s := &S3Source{}
+		if err := s.Restore(&contexts[i]); err != nil {
+			t.Fatalf("restore %s: %v", contexts[i].Name, err)
+		}
+		if err := s.items.attach(contexts[i].Name, config.State, nil); err != nil {
+			t.Fatalf("attach %s: %v", contexts[i].Name, err)
+		}
+		manager.RegisterSource(contexts[i].Name, s)
+	}
+	return manager
+}
+
+func TestSourceItemsConcurrentMatchAndReplace(t *testing.T) {
+	generation := func(from int) []CacheItem {
+		items := make([]CacheItem, 0, testObjectCount)
+		for i := from; i < from+testObjectCount; i++ {
+			items = append(items, CacheItem{
+				ItemId: fmt.Sprintf("object-%d", i),
+				Hashes: map[string]string{"md5": testObjectHash(i)},
+			})
+		}
+		return items
+	}
+	store, err := state.OpenJsonStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open state store: %v", err)
+	}
+	defer store.Close()
+	items := &sourceItems{}
+	if err := items.attach("source", store, nil); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	items.Replace(generation(0))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < testRounds; round++ {
+			items.Replace(generation(round % testObjectCount))
+		}
+	}()
+	for w := 0; w < testWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; round < testRounds; round++ {
+				// Object testObjectCount-1 is part of every generation, the
+				// others come and go.
+				i := testObjectCount - 1
+				if round%2 == 1 {
+					i = (w + round) % (2 * testObjectCount)
+				}
+				reqUrl := fmt.Sprintf("/library/parts/%d/%d/file.mkv", w, round)
+				if _, err := items.Match(reqUrl, map[string]string{"md5": testObjectHash(i)}); err != nil {
+					continue
+				}
+				// A refresh may drop the mapping of an object that left
+				// the generation in between.
+				item, err := items.Lookup(reqUrl)
+				if err != nil && i == testObjectCount-1 {
+					t.Errorf("lookup %s: %v", reqUrl, err)
+					return
+				} else if err != nil {
+					continue
+				}
+				if item.Hashes["md5"] != testObjectHash(i) {
+					t.Errorf("lookup %s: got %s, want object-%d", reqUrl, item.ItemId, i)
+					return
+				}
+				items.HasMapping(reqUrl)
+				items.Len()
+				items.MappedLen()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	content, err := store.Get(config.ItemsBucket, "source")
+	if err != nil {
+		t.Fatalf("get stored items: %v", err)
+	}
+	var persisted []CacheItem
+	if err := json.Unmarshal(content, &persisted); err != nil {
+		t.Fatalf("decode stored items: %v", err)
+	}
+	snapshot := items.Items()
+	if len(persisted) != len(snapshot) || persisted[0].ItemId != snapshot[0].ItemId {
+		t.Errorf("stored items are not the last snapshot")
+	}
+}
+
+func TestSourceItemsMatchFollowsReplace(t *testing.T) {
+	sum := md5.Sum([]byte("object"))
+	items := &sourceItems{}
+	items.Replace([]CacheItem{
+		{ItemId: "other", Hashes: map[string]string{"md5": testObjectHash(1)}},
+		{ItemId: "hex", Hashes: map[string]string{"MD5": hex.EncodeToString(sum[:])}},
+	})
+
+	hashes := map[string]string{"md5": base64.StdEncoding.EncodeToString(sum[:]), "sha1": "unused"}
+	item, err := items.Match("/library/parts/1/file.mkv", hashes)
+	if err != nil || item.ItemId != "hex" {
+		t.Fatalf("match before replace: got %v, %v", item, err)
+	}
+
+	items.Replace([]CacheItem{
+		{ItemId: "both", Hashes: map[string]string{"md5": hex.EncodeToString(sum[:]), "sha256": "missing"}},
+		{ItemId: "replaced", Hashes: map[string]string{"md5": base64.StdEncoding.EncodeToString(sum[:])}},
+	})
+	item, err = items.Match("/library/parts/2/file.mkv", hashes)
+	if err != nil || item.ItemId != "replaced" {
+		t.Fatalf("match after replace: got %v, %v", item, err)
+	}
+	if items.HasMapping("/library/parts/1/file.mkv") {
+		t.Error("mapping of an item that is gone survived the replace")
+	}
+	if _, err := items.Match("/library/parts/3/file.mkv", map[string]string{"md5": testObjectHash(1)}); err == nil {
+		t.Error("matched an item that is gone after the replace")
+	}
+
+	// A file uploaded over another one keeps its path, which is the id of
+	// S3 and WebDAV items.
+	items.Replace([]CacheItem{
+		{ItemId: "both", Hashes: map[string]string{"MD5": base64.StdEncoding.EncodeToString(sum[:]), "sha256": "missing"}},
+		{ItemId: "replaced", Hashes: map[string]string{"md5": testObjectHash(2)}},
+	})
+	if items.HasMapping("/library/parts/2/file.mkv") {
+		t.Error("mapping of an item whose hashes changed survived the replace")
+	}
+	if _, err := items.Match("/library/parts/4/file.mkv", map[string]string{"md5": hex.EncodeToString(sum[:]), "sha256": "missing"}); err != nil {
+		t.Fatalf("match: %v", err)
+	}
+	items.Replace([]CacheItem{
+		{ItemId: "both", Hashes: map[string]string{"md5": hex.EncodeToString(sum[:]), "sha256": "missing"}},
+	})
+	if !items.HasMapping("/library/parts/4/file.mkv") {
+		t.Error("mapping was dropped although only the notation of the hash changed")
+	}
+}
+
+func TestMappingStoreSurvivesRestart(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "context.db")
+	persisted := []CacheItem{
+		{ItemId: "kept", DriveId: "drive", Hashes: map[string]string{"md5": testObjectHash(1)}},
+		{ItemId: "removed", DriveId: "drive", Hashes: map[string]string{"md5": testObjectHash(2)}},
+	}
+	var stateStore *state.BoltStore
+	restart := func() (*MappingStore, *sourceItems) {
+		var err error
+		if stateStore, err = state.OpenBoltStore(filename); err != nil {
+			t.Fatalf("open state store: %v", err)
+		}
+		store := NewMappingStore(stateStore)
+		items := &sourceItems{}
+		if err := items.attach("source", stateStore, store); err != nil {
+			t.Fatalf("attach: %v", err)
+		}
+		return store, items
+	}
+	stop := func(store *MappingStore) {
+		if err := store.Close(); err != nil {
+			t.Fatalf("close store: %v", err)
+		}
+		if err := stateStore.Close(); err != nil {
+			t.Fatalf("close state store: %v", err)
+		}
+	}
+
+	store, items := restart()
+	items.Replace(persisted)
+	for i, reqUrl := range []string{"/library/parts/1/file.mkv", "/library/parts/2/file.mkv"} {
+		if _, err := items.Match(reqUrl, map[string]string{"md5": testObjectHash(i + 1)}); err != nil {
+			t.Fatalf("match %s: %v", reqUrl, err)
+		}
+	}
+	stop(store)
+
+	store, items = restart()
+	if item, err := items.Lookup("/library/parts/2/file.mkv"); err != nil || item.ItemId != "removed" {
+		t.Fatalf("lookup after restart: got %v, %v", item, err)
+	}
+	items.Replace(persisted[:1])
+	stop(store)
+
+	store, items = restart()
+	defer stop(store)
+	if item, err := items.Lookup("/library/parts/1/file.mkv"); err != nil || item.ItemId != "kept" {
+		t.Errorf("lookup of kept item: got %v, %v", item, err)
+	}
+	if items.HasMapping("/library/parts/2/file.mkv") {
+		t.Error("mapping of a removed item was loaded again")
+	}
+}
+
+func TestSourcesManagerConcurrentMappingAndRefresh(t *testing.T) {
+	manager := newTestManager(t, "first", "second")
+	for _, name := range []string{"first", "second"} {
+		if _, err := manager.Refresh(name); err != nil {
+			t.Fatalf("refresh %s: %v", name, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"first", "second"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for round := 0; round < testRounds/20; round++ {
+				if _, err := manager.Refresh(name); err != nil {
+					t.Errorf("refresh %s: %v", name, err)
+					return
+				}
+			}
+		}(name)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < testRounds/20; round++ {
+			if err := config.SaveContext(); err != nil {
+				t.Errorf("save context: %v", err)
+				return
+			}
+		}
+	}()
+	for w := 0; w < testWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; round < testRounds; round++ {
+				reqUrl := fmt.Sprintf("/library/parts/%d/%d/file.mkv", w, round)
+				hashes := map[string]string{"md5": testObjectHash(testObjectCount)}
+				if err := manager.MappingFile(reqUrl, "file.mkv", hashes); err != nil {
+					t.Errorf("mapping %s: %v", reqUrl, err)
+					return
+				}
+				if !manager.HasMapping(reqUrl) {
+					t.Errorf("mapping %s: not found after mapping", reqUrl)
+					return
+				}
+				for _, name := range []string{"first", "second"} {
+					url, err := manager.GetSource(name).GetUrl(reqUrl)
+					if err != nil {
+						t.Errorf("get url %s: %v", reqUrl, err)
+						return
+					}
+					if len(url) == 0 {
+						t.Errorf("get url %s: empty url", reqUrl)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestSourcesManagerSerializesRefreshes(t *testing.T) {
+	manager := &SourcesManager{}
+	s := &countingSource{}
+	manager.RegisterSource("counting", s)
+
+	var wg sync.WaitGroup
+	for w := 0; w < testWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := manager.Refresh("counting"); err != nil {
+				t.Errorf("refresh: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&s.overlapped) != 0 {
+		t.Error("refreshes of one source overlapped")
+	}
+	if s.refreshes != testWorkers {
+		t.Errorf("got %d refreshes, want %d", s.refreshes, testWorkers)
+	}
+	if _, err := manager.Refresh("missing"); err == nil {
+		t.Error("refresh of a missing source succeeded")
+	}
+}
+
+func TestSourcesManagerCancelsRefresh(t *testing.T) {
+	manager := &SourcesManager{}
+	s := &blockingSource{started: make(chan struct{}, 1)}
+	manager.RegisterSource("blocking", s)
+	if err := manager.Cancel("blocking"); err == nil {
+		t.Error("canceled a refresh that isn't running")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := manager.Refresh("blocking")
+		done <- err
+	}()
+	<-s.started
+	if !manager.RefreshStatus("blocking").Running {
+		t.Error("running refresh is not recorded")
+	}
+	if err := manager.Cancel("blocking"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("refresh after cancel: got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("refresh didn't stop after cancel")
+	}
+	status := manager.RefreshStatus("blocking")
+	if status.Running || status.LastRun.IsZero() || status.Error != context.Canceled.Error() {
+		t.Errorf("status after cancel: got %+v", status)
+	}
+}
+
+func TestRefreshSchedulerRunsDueSources(t *testing.T) {
+	manager := &SourcesManager{}
+	due, later := &countingSource{}, &countingSource{}
+	manager.RegisterSource("due", due)
+	manager.RegisterSource("later", later)
+	scheduler := NewRefreshScheduler(manager)
+	now := time.Now()
+	scheduler.Register("due", time.Hour, now.Add(-2*time.Hour))
+	scheduler.Register("later", time.Hour, now)
+
+	if wait := scheduler.refreshDue(time.Now()); wait < 59*time.Minute {
+		t.Errorf("wait until the next refresh: got %v", wait)
+	}
+	running := func() bool {
+		scheduler.lock.Lock()
+		defer scheduler.lock.Unlock()
+		return scheduler.entries["due"].running
+	}
+	for deadline := time.Now().Add(time.Second); running() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if due.refreshes != 1 || later.refreshes != 0 {
+		t.Fatalf("got %d and %d refreshes, want 1 and 0", due.refreshes, later.refreshes)
+	}
+	next := manager.RefreshStatus("due").NextRun
+	if min, max := now.Add(time.Hour), time.Now().Add(time.Hour+time.Hour/10); next.Before(min) || next.After(max) {
+		t.Errorf("next run %v is not within an interval and its jitter", next)
+	}
+	if err := scheduler.Trigger("missing"); err == nil {
+		t.Error("triggered a missing source")
+	}
+}
+
+// blockingSource refreshes until it is canceled.
+type blockingSource struct {
+	countingSource
+	started chan struct{}
+}
+
+func (p *blockingSource) RefreshSource(ctx context.Context) ([]CacheItem, error) {
+	p.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// countingSource records whether its refreshes ever overlapped.
+type countingSource struct {
+	sourceItems
+	running    int32
+	refreshes  int
+	overlapped int32
+}
+
+func (p *countingSource) RefreshSource(ctx context.Context) ([]CacheItem, error) {
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		atomic.StoreInt32(&p.overlapped, 1)
+		return nil, nil
+	}
+	defer atomic.StoreInt32(&p.running, 0)
+	time.Sleep(time.Millisecond)
+	p.refreshes++
+	return nil, nil
+}
+
+func (p *countingSource) GetUrl(reqFileUrl string) (string, error) { return "", nil }
+
+func (p *countingSource) MappingFile(reqFileUrl string, localName string, hashes map[string]string) error {
+	_, err := p.Match(reqFileUrl, hashes)
+	return err
+}
+
+func (p *countingSource) RestoreSource(items *[]CacheItem) { p.Replace(*items) }
+
+func (p *countingSource) CachedFileSize() int { return p.Len() }
+
+func (p *countingSource) MappedFileSize() int { return p.MappedLen() }
+
+func (p *countingSource) Restore(context *CacheSourceContext) error { return nil }
@@ -0,0 +1,103 @@
+package source
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/config"
+	"xxtuitui.com/filesvr/state"
+)
+
+type (
+	flightCall[T any] struct {
+		done  chan struct{}
+		value T
+		err   error
+	}
+
+	// flightGroup coalesces concurrent calls with the same key, callers that
+	// arrive while a call is running wait for it and share its result. The
+	// zero value is ready to use.
+	flightGroup[T any] struct {
+		lock  sync.Mutex
+		calls map[string]*flightCall[T]
+	}
+)
+
+func (p *flightGroup[T]) Do(key string, fn func() (T, error)) (T, error) {
+	p.lock.Lock()
+	if p.calls == nil {
+		p.calls = make(map[string]*flightCall[T])
+	}
+	if c, ok := p.calls[key]; ok {
+		p.lock.Unlock()
+		<-c.done
+		return c.value, c.err
+	}
+	c := &flightCall[T]{done: make(chan struct{})}
+	p.calls[key] = c
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		delete(p.calls, key)
+		p.lock.Unlock()
+		close(c.done)
+	}()
+	c.value, c.err = fn()
+	return c.value, c.err
+}
+
+// saveContext saves the whole context and only logs failures, a source whose
+// token was renewed keeps working even if the state can't be written.
+func saveContext() {
+	if err := config.SaveContext(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"statePath": config.App.StatePath,
+			"err":       err,
+		}).Warn("SaveContextFailed")
+	}
+}
+
+// saveSourceContext saves only the context of the source that owns
+// sourceContext, the typed context set by DecodeContext.
+func saveSourceContext(sourceContext interface{}) {
+	record := sourceRecord(sourceContext)
+	if record == nil {
+		saveContext()
+		return
+	}
+	var err error
+	if shared, ok := config.State.(state.Shared); ok {
+		err = syncSharedContext(shared, record, nil)
+	} else {
+		err = config.SaveSource(record.Name, record)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"sourceName": record.Name,
+			"statePath":  config.App.StatePath,
+			"err":        err,
+		}).Warn("SaveContextFailed")
+	}
+}
+
+// sourceRecord returns a copy of the entry of App.Sources that holds
+// sourceContext, nil if there is none.
+func sourceRecord(sourceContext interface{}) *CacheSourceContext {
+	var record *CacheSourceContext
+	config.Update(func() {
+		list, ok := config.App.Sources.(*CacheSourceContextList)
+		if !ok {
+			return
+		}
+		for i := range *list {
+			if (*list)[i].Context == sourceContext {
+				entry := (*list)[i]
+				record = &entry
+				break
+			}
+		}
+	})
+	return record
+}
@@ -0,0 +1,205 @@
+package source
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/config"
+	"xxtuitui.com/filesvr/gdriveapi"
+)
+
+type (
+	GoogleDriveContext struct {
+		ServiceAccountFile string    `json:"serviceAccountFile"`
+		Subject            string    `json:"subject"`
+		ClientId           string    `json:"clientId"`
+		ClientSecret       string    `json:"clientSecret"`
+		RefreshToken       string    `json:"refreshToken"`
+		DriveId            string    `json:"driveId"`
+		RootFolderId       string    `json:"rootFolderId"`
+		BaseUrl            string    `json:"baseUrl"`
+		TokenUrl           string    `json:"tokenUrl"`
+		LastRefreshTime    time.Time `json:"lastRefreshTime"`
+	}
+
+	GoogleDriveSource struct {
+		Context *GoogleDriveContext
+		items   sourceItems
+		Client  *gdriveapi.DriveClient
+
+		tokenCalls flightGroup[struct{}]
+	}
+)
+
+// googleDriveTokenMargin is how long before expiry an access token is
+// renewed, a relayed request must not run into an expired token.
+const googleDriveTokenMargin = 10 * time.Minute
+
+func init() {
+	RegisterSourceType(SourceType{
+		Name:   "GoogleDrive",
+		Schema: SchemaOf(GoogleDriveContext{}),
+		// Drive serves files only with the access token, which must not
+		// reach clients, so they are always relayed.
+		Capabilities: SourceCapabilities{
+			Hashes: []string{"md5", "sha1", "sha256"},
+			Relay:  true,
+		},
+		New: func() CacheSource { return &GoogleDriveSource{} },
+	})
+}
+
+func (p *GoogleDriveSource) Restore(context *CacheSourceContext) error {
+	sourceContext, err := DecodeContext[GoogleDriveContext](context)
+	if err != nil {
+		return err
+	}
+	p.Context = sourceContext
+
+	useServiceAccount := len(p.Context.ServiceAccountFile) != 0
+	useRefreshToken := len(p.Context.ClientId) != 0 && len(p.Context.ClientSecret) != 0 && len(p.Context.RefreshToken) != 0
+	if !useServiceAccount && !useRefreshToken {
+		return errors.New("InvalidContext")
+	}
+	if len(p.Context.RootFolderId) == 0 {
+		p.Context.RootFolderId = "root"
+		if len(p.Context.DriveId) != 0 {
+			p.Context.RootFolderId = p.Context.DriveId
+		}
+	}
+	return rotateToken(p.Context, p.Init)
+}
+
+func (p *GoogleDriveSource) Init() error {
+	if p.Client == nil {
+		p.Client = gdriveapi.NewDriveClient(p.Context.BaseUrl, p.Context.TokenUrl)
+	}
+	if len(p.Context.ServiceAccountFile) != 0 {
+		content, err := os.ReadFile(p.Context.ServiceAccountFile)
+		if err != nil {
+			return err
+		}
+		var key gdriveapi.ServiceAccountKey
+		if err := json.Unmarshal(content, &key); err != nil {
+			return err
+		}
+		if _, err := p.Client.GetTokenByServiceAccount(&key, gdriveapi.ReadonlyScope, p.Context.Subject); err != nil {
+			return err
+		}
+	} else {
+		token, err := p.Client.GetTokenByRefreshToken(p.Context.ClientId, p.Context.ClientSecret, p.Context.RefreshToken)
+		if err != nil {
+			return err
+		}
+		if len(token.RefreshToken) != 0 {
+			config.Update(func() {
+				p.Context.RefreshToken = token.RefreshToken
+			})
+		}
+	}
+	config.Update(func() {
+		p.Context.LastRefreshTime = time.Now()
+	})
+	logrus.WithFields(logrus.Fields{
+		"driveId":   p.Context.DriveId,
+		"expiresAt": p.Client.TokenExpiry(),
+	}).Info("GoogleDriveSourceInitialized")
+	return nil
+}
+
+func (p *GoogleDriveSource) MappingFile(reqFileUrl string, localName string, hashes map[string]string) error {
+	_, err := p.items.Match(reqFileUrl, hashes)
+	return err
+}
+
+func (p *GoogleDriveSource) GetUrl(reqFileUrl string) (string, error) {
+	item, err := p.items.Lookup(reqFileUrl)
+	if err != nil {
+		return "", err
+	}
+	if p.Client.IsTokenExpired(googleDriveTokenMargin) {
+		logrus.Info("GoogleDriveApiTokenExpired")
+		if err := p.RefreshToken(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"reqUrl": reqFileUrl,
+				"err":    err,
+			}).Info("GoogleDriveGetUrlFailed")
+			return "", err
+		}
+	}
+	return p.Client.DownloadUrl(item.ItemId), nil
+}
+
+func (p *GoogleDriveSource) TokenExpiry() time.Time {
+	return p.Client.TokenExpiry()
+}
+
+// RefreshToken signs in again with the service account key or the stored
+// refresh token and saves the context.
+func (p *GoogleDriveSource) RefreshToken() error {
+	_, err := p.tokenCalls.Do("", func() (struct{}, error) {
+		return struct{}{}, rotateToken(p.Context, p.Init)
+	})
+	return err
+}
+
+// RelayHeader authorizes the relayed request for a url from GetUrl.
+func (p *GoogleDriveSource) RelayHeader() http.Header {
+	return p.Client.AuthHeader()
+}
+
+func (p *GoogleDriveSource) RefreshSource(ctx context.Context) ([]CacheItem, error) {
+	files, err := p.Client.ListFileRecursive(ctx, p.Context.RootFolderId, p.Context.DriveId)
+	if err != nil {
+		return nil, err
+	}
+	res := []CacheItem{}
+	for _, f := range files {
+		hashes := make(map[string]string)
+		for name, digest := range map[string]string{
+			"md5":    f.Md5Checksum,
+			"sha1":   f.Sha1Checksum,
+			"sha256": f.Sha256Checksum,
+		} {
+			content, err := hex.DecodeString(digest)
+			if err != nil || len(content) == 0 {
+				continue
+			}
+			hashes[name] = base64.StdEncoding.EncodeToString(content)
+		}
+		if len(hashes) == 0 {
+			continue
+		}
+		res = append(res, CacheItem{
+			ItemId:     f.Id,
+			Hashes:     hashes,
+			CachedPath: f.Path,
+		})
+	}
+	logrus.WithFields(logrus.Fields{
+		"count": len(res),
+	}).Info("GoogleDriveRefreshSource")
+	p.items.Replace(res)
+	return res, nil
+}
+
+func (p *GoogleDriveSource) RestoreSource(items *[]CacheItem) {
+	p.items.Replace(*items)
+}
+
+func (p *GoogleDriveSource) MappedFileSize() int { return p.items.MappedLen() }
+
+func (p *GoogleDriveSource) CachedFileSize() int { return p.items.Len() }
+
+func (p *GoogleDriveSource) cachedItems() *sourceItems { return &p.items }
+
+func (p *GoogleDriveSource) HasMapping(reqUrl string) bool {
+	return p.items.HasMapping(reqUrl)
+}
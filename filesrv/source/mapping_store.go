@@ -0,0 +1,172 @@
+package source
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/state"
+)
+
+type (
+	// MappingRef is what is stored of a mapping, the item it is resolved to
+	// is looked up in the items of the source.
+	MappingRef struct {
+		ItemId  string `json:"itemId"`
+		DriveId string `json:"driveId,omitempty"`
+	}
+
+	// MappingStore keeps the mappings of every source in the state store, so
+	// redirects work right after a restart. Writes are queued and committed
+	// in the background, a request never waits for the disk.
+	MappingStore struct {
+		store   state.Store
+		lock    sync.Mutex
+		pending map[string]map[string]*MappingRef
+		// flushing keeps changes of the same key committed in order.
+		flushing sync.Mutex
+		wake     chan struct{}
+		stop     chan struct{}
+		done     chan struct{}
+	}
+)
+
+// mappingsBucket is the prefix of the bucket of every source, a source
+// is loaded without reading the mappings of the others.
+const mappingsBucket = "mappings/"
+
+// Mappings is the store of the running server, mappings are only kept in
+// memory while it is nil.
+var Mappings *MappingStore
+
+func NewMappingStore(store state.Store) *MappingStore {
+	p := &MappingStore{
+		store:   store,
+		pending: make(map[string]map[string]*MappingRef),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Load returns the stored mappings of the source by request url.
+func (p *MappingStore) Load(sourceName string) (map[string]MappingRef, error) {
+	if err := p.Flush(); err != nil {
+		return nil, err
+	}
+	records, err := p.store.List(mappingsBucket + sourceName)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]MappingRef, len(records))
+	for reqUrl, content := range records {
+		var ref MappingRef
+		if err := json.Unmarshal(content, &ref); err != nil {
+			return nil, err
+		}
+		res[reqUrl] = ref
+	}
+	return res, nil
+}
+
+// Get returns the mapping of reqUrl, it returns state.ErrNotFound if there
+// is none.
+func (p *MappingStore) Get(sourceName string, reqUrl string) (MappingRef, error) {
+	p.lock.Lock()
+	ref, queued := p.pending[sourceName][reqUrl]
+	p.lock.Unlock()
+	if queued {
+		if ref == nil {
+			return MappingRef{}, state.ErrNotFound
+		}
+		return *ref, nil
+	}
+	var res MappingRef
+	content, err := p.store.Get(mappingsBucket+sourceName, reqUrl)
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(content, &res)
+	return res, err
+}
+
+func (p *MappingStore) Put(sourceName string, reqUrl string, ref MappingRef) {
+	p.queue(sourceName, reqUrl, &ref)
+}
+
+func (p *MappingStore) Delete(sourceName string, reqUrls []string) {
+	for _, reqUrl := range reqUrls {
+		p.queue(sourceName, reqUrl, nil)
+	}
+}
+
+func (p *MappingStore) queue(sourceName string, reqUrl string, ref *MappingRef) {
+	p.lock.Lock()
+	changes, ok := p.pending[sourceName]
+	if !ok {
+		changes = make(map[string]*MappingRef)
+		p.pending[sourceName] = changes
+	}
+	changes[reqUrl] = ref
+	p.lock.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Flush commits the queued changes.
+func (p *MappingStore) Flush() error {
+	p.flushing.Lock()
+	defer p.flushing.Unlock()
+	p.lock.Lock()
+	pending := p.pending
+	p.pending = make(map[string]map[string]*MappingRef)
+	p.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	for sourceName, changes := range pending {
+		records := make(map[string][]byte, len(changes))
+		for reqUrl, ref := range changes {
+			if ref == nil {
+				records[reqUrl] = nil
+				continue
+			}
+			content, err := json.Marshal(ref)
+			if err != nil {
+				return err
+			}
+			records[reqUrl] = content
+		}
+		if err := p.store.Write(mappingsBucket+sourceName, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close commits the queued changes, the state store is left open.
+func (p *MappingStore) Close() error {
+	close(p.stop)
+	<-p.done
+	return p.Flush()
+}
+
+func (p *MappingStore) run() {
+	defer close(p.done)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.wake:
+		}
+		if err := p.Flush(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("SaveMappingsFailed")
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package source
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/config"
+	"xxtuitui.com/filesvr/msgraphapi"
+)
+
+type (
+	// OneDriveFolder is the part of a folder kept between delta queries, the
+	// delta responses carry no paths so they are rebuilt from the folder
+	// tree. Path is only set on the folder of a root path.
+	OneDriveFolder struct {
+		Name     string `json:"name"`
+		ParentId string `json:"parentId"`
+		IsRoot   bool   `json:"isRoot,omitempty"`
+		Path     string `json:"path,omitempty"`
+	}
+
+	// OneDriveRoot is what is kept of a root path of the filter between
+	// refreshes. Id is the item id of its folder, empty for the drive root.
+	OneDriveRoot struct {
+		Id        string                    `json:"id,omitempty"`
+		DeltaLink string                    `json:"deltaLink,omitempty"`
+		Folders   map[string]OneDriveFolder `json:"folders,omitempty"`
+	}
+)
+
+const (
+	oneDriveMaxFolderDepth = 256
+	oneDriveRootPath       = "/drive/root:"
+)
+
+// RefreshSource indexes every root path of the filter, so the trees outside
+// of them are never listed. Personal drives query the changes of each root
+// since the last refresh with its own delta link. Business drives support
+// delta queries on the drive root only, their root paths are walked folder
+// by folder.
+func (p *OneDriveSource) RefreshSource(ctx context.Context) ([]CacheItem, error) {
+	filterKey := p.Context.Filter.Key()
+	previous := p.Context.Roots
+	if p.Context.DeltaFilter != filterKey {
+		previous = nil
+	}
+	snapshot := p.items.Items()
+	roots := make(map[string]OneDriveRoot)
+	var res []CacheItem
+	for _, root := range p.Context.Filter.Roots() {
+		var (
+			items []CacheItem
+			state OneDriveRoot
+			err   error
+		)
+		if p.personal || root == "/" {
+			items, state, err = p.refreshRoot(ctx, root, previous[root], snapshot)
+		} else {
+			items, err = p.walkRoot(ctx, root)
+		}
+		if err != nil {
+			return nil, err
+		}
+		roots[root] = state
+		res = append(res, items...)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"count": len(res),
+		"roots": len(roots),
+	}).Info("OneDriveRefreshSource")
+	p.items.Replace(res)
+	config.Update(func() {
+		p.Context.Roots = roots
+		p.Context.DeltaFilter = filterKey
+	})
+	return res, nil
+}
+
+// refreshRoot applies the changes reported by the delta api for root since
+// the last refresh to the items of the snapshot below root. Without a delta
+// link, or when the link expired, the root is enumerated again. Files
+// outside the filter are dropped while the changes are applied.
+func (p *OneDriveSource) refreshRoot(ctx context.Context, root string, state OneDriveRoot, snapshot []CacheItem) ([]CacheItem, OneDriveRoot, error) {
+	changes, deltaLink, err := p.Client.FolderDelta(ctx, root, state.DeltaLink)
+	resync := len(state.DeltaLink) == 0
+	if err != nil && err.Code == msgraphapi.ResyncRequired && !resync {
+		logrus.WithFields(logrus.Fields{
+			"root":    root,
+			"errCode": err.Err,
+			"message": err.Message,
+		}).Warn("OneDriveDeltaResyncRequired")
+		changes, deltaLink, err = p.Client.FolderDelta(ctx, root, "")
+		resync = true
+	}
+	if err != nil {
+		if err.Code == msgraphapi.ItemNotFound && root != "/" {
+			return nil, OneDriveRoot{}, nil
+		}
+		return nil, OneDriveRoot{}, err
+	}
+
+	items := make(map[string]CacheItem)
+	folders := make(map[string]OneDriveFolder)
+	if resync && root != "/" {
+		folder, err := p.Client.GetDriveItemByPath(root)
+		if err != nil {
+			return nil, OneDriveRoot{}, err
+		}
+		state.Id = folder.Id
+	} else if !resync {
+		for _, item := range snapshot {
+			if isSubPath(strings.TrimPrefix(item.CachedPath, oneDriveRootPath), root) {
+				items[item.ItemId] = item
+			}
+		}
+		for id, folder := range state.Folders {
+			folders[id] = folder
+		}
+	}
+	if len(state.Id) != 0 {
+		folders[state.Id] = OneDriveFolder{IsRoot: true, Path: oneDriveRootPath + root}
+	}
+	for _, change := range changes {
+		if change.Deleted != nil {
+			delete(items, change.Id)
+			delete(folders, change.Id)
+			continue
+		}
+		parentId := ""
+		if change.ParentReference != nil {
+			parentId = change.ParentReference.Id
+		}
+		switch {
+		case change.Id == state.Id:
+			// The folder of the root path keeps its path when renamed.
+		case change.Root != nil:
+			folders[change.Id] = OneDriveFolder{IsRoot: true}
+		case change.Folder != nil:
+			folders[change.Id] = OneDriveFolder{Name: change.Name, ParentId: parentId}
+		case change.File != nil && len(change.File.Hashes.QuickXorHash) != 0:
+			items[change.Id] = CacheItem{
+				ItemId:     change.Id,
+				Hashes:     map[string]string{"quickxorhash": change.File.Hashes.QuickXorHash},
+				CachedPath: change.Name,
+				ParentId:   parentId,
+				Size:       change.Size,
+			}
+		default:
+			// A file without a hash is unusable, drop the previous version.
+			delete(items, change.Id)
+		}
+	}
+
+	// Drop everything below deleted folders, and rebuild paths.
+	paths := make(map[string]string)
+	for id := range folders {
+		if _, ok := folderPath(folders, paths, id); !ok {
+			delete(folders, id)
+		}
+	}
+	res := make([]CacheItem, 0, len(items))
+	for _, item := range items {
+		folderPath, ok := paths[item.ParentId]
+		if !ok {
+			continue
+		}
+		name := path.Base(item.CachedPath)
+		if !p.Context.Filter.MatchFile(strings.TrimPrefix(folderPath, oneDriveRootPath)+"/"+name, item.Size) {
+			continue
+		}
+		item.CachedPath = strings.TrimSuffix(folderPath, "/") + "/" + name
+		res = append(res, item)
+	}
+	logrus.WithFields(logrus.Fields{
+		"root":    root,
+		"count":   len(res),
+		"changes": len(changes),
+		"resync":  resync,
+	}).Info("OneDriveDeltaApplied")
+	state.DeltaLink = deltaLink
+	state.Folders = folders
+	return res, state, nil
+}
+
+// walkRoot lists root folder by folder, folders the filter excludes are
+// never listed.
+func (p *OneDriveSource) walkRoot(ctx context.Context, root string) ([]CacheItem, error) {
+	folder, apiErr := p.Client.GetDriveItemByPath(root)
+	if apiErr != nil {
+		if apiErr.Code == msgraphapi.ItemNotFound {
+			return nil, nil
+		}
+		return nil, apiErr
+	}
+	type pendingFolder struct {
+		id   string
+		path string
+	}
+	var res []CacheItem
+	pending := []pendingFolder{{id: folder.Id, path: root}}
+	for len(pending) != 0 {
+		current := pending[0]
+		pending = pending[1:]
+		children, err := p.Client.ListChildByItemIdContext(ctx, current.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			childPath := path.Join(current.path, child.Name)
+			switch {
+			case child.Folder != nil:
+				if p.Context.Filter.WalkFolder(childPath) {
+					pending = append(pending, pendingFolder{id: child.Id, path: childPath})
+				}
+			case child.File != nil && len(child.File.Hashes.QuickXorHash) != 0:
+				if !p.Context.Filter.MatchFile(childPath, child.Size) {
+					continue
+				}
+				res = append(res, CacheItem{
+					ItemId:     child.Id,
+					Hashes:     map[string]string{"quickxorhash": child.File.Hashes.QuickXorHash},
+					CachedPath: oneDriveRootPath + childPath,
+					ParentId:   current.id,
+					Size:       child.Size,
+				})
+			}
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"root":  root,
+		"count": len(res),
+	}).Info("OneDriveRootWalked")
+	return res, nil
+}
+
+// folderPath resolves the path of folder id in the /drive/root:/a/b form of
+// ItemReference.Path. It fails when an ancestor is no longer known, which
+// happens once the ancestor was deleted.
+func folderPath(folders map[string]OneDriveFolder, paths map[string]string, id string) (string, bool) {
+	var chain []string
+	current := id
+	for depth := 0; depth < oneDriveMaxFolderDepth; depth++ {
+		if resolved, ok := paths[current]; ok {
+			return joinFolderPath(folders, paths, resolved, id, chain), true
+		}
+		folder, ok := folders[current]
+		if !ok {
+			return "", false
+		}
+		if folder.IsRoot {
+			paths[current] = oneDriveRootPath
+			if len(folder.Path) != 0 {
+				paths[current] = folder.Path
+			}
+			return joinFolderPath(folders, paths, paths[current], id, chain), true
+		}
+		chain = append(chain, current)
+		current = folder.ParentId
+	}
+	return "", false
+}
+
+// joinFolderPath records the path of every folder of chain, which lists the
+// folders from id up to the folder whose path is base.
+func joinFolderPath(folders map[string]OneDriveFolder, paths map[string]string, base string, id string, chain []string) string {
+	for i := len(chain) - 1; i >= 0; i-- {
+		base = strings.TrimSuffix(base, "/") + "/" + folders[chain[i]].Name
+		paths[chain[i]] = base
+	}
+	return paths[id]
+}
@@ -2,9 +2,10 @@ package source
 
 import (
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/mitchellh/mapstructure"
 	"github.com/sirupsen/logrus"
 	"xxtuitui.com/filesvr/config"
 	"xxtuitui.com/filesvr/msgraphapi"
@@ -12,34 +13,133 @@ import (
 
 type (
 	OneDriveContext struct {
-		ClientId        string      `json:"clientId"`
-		ClientSecret    string      `json:"clientSecret"`
-		User            string      `json:"user"`
-		LastRefreshTime time.Time   `json:"lastRefreshTime"`
-		TenantId        string      `json:"tenantId"`
-		CachedItems     []CacheItem `json:"cachedItems"`
+		ClientId              string                  `json:"clientId" source:"required"`
+		ClientSecret          string                  `json:"clientSecret"`
+		CertificatePath       string                  `json:"certificatePath"`
+		CertificatePassword   string                  `json:"certificatePassword"`
+		CertificateThumbprint string                  `json:"certificateThumbprint"`
+		User                  string                  `json:"user"`
+		SiteId                string                  `json:"siteId"`
+		SiteUrl               string                  `json:"siteUrl"`
+		DriveId               string                  `json:"driveId"`
+		DriveName             string                  `json:"driveName"`
+		RefreshToken          string                  `json:"refreshToken"`
+		LastRefreshTime       time.Time               `json:"lastRefreshTime"`
+		TenantId              string                  `json:"tenantId"`
+		Cloud                 string                  `json:"cloud"`
+		LoginEndpoint         string                  `json:"loginEndpoint"`
+		GraphEndpoint         string                  `json:"graphEndpoint"`
+		Scope                 string                  `json:"scope"`
+		UrlCacheTtlSec        int                     `json:"urlCacheTtlSec"`
+		Filter                SourceFilter            `json:"filter"`
+		DeltaFilter           string                  `json:"deltaFilter,omitempty"`
+		Roots                 map[string]OneDriveRoot `json:"roots"`
 	}
 
 	OneDriveSource struct {
-		Context *OneDriveContext
-		mapping map[string]*CacheItem
-		Client  *msgraphapi.MSGraphClient
+		Context     *OneDriveContext
+		items       sourceItems
+		urls        *UrlCache
+		urlCalls    flightGroup[string]
+		tokenCalls  flightGroup[struct{}]
+		Client      *msgraphapi.MSGraphClient
+		personal    bool
+		cloud       msgraphapi.CloudEnvironment
+		certificate *msgraphapi.ClientCertificate
 	}
 )
 
+// oneDriveLogins holds the names of the sources whose device code login is
+// running.
+var oneDriveLogins = struct {
+	lock    sync.Mutex
+	running map[string]bool
+}{running: make(map[string]bool)}
+
+// oneDrivePersonalScope is requested by the delegated flows of consumer
+// accounts, offline_access makes the token endpoint return refresh tokens.
+const oneDrivePersonalScope = "Files.Read.All offline_access"
+
+// defaultOneDriveUrlCacheTtlSec is used for download urls without tempauth,
+// Graph documents them as valid for a short time only.
+const defaultOneDriveUrlCacheTtlSec = 3600
+
+func init() {
+	RegisterSourceType(SourceType{
+		Name:   "OneDriveForBusiness",
+		Schema: SchemaOf(OneDriveContext{}),
+		Capabilities: SourceCapabilities{
+			Hashes:   []string{"quickxorhash"},
+			Redirect: true,
+		},
+		New: func() CacheSource { return &OneDriveSource{} },
+	})
+	RegisterSourceType(SourceType{
+		Name:   "OneDrivePersonal",
+		Schema: SchemaOf(OneDriveContext{}),
+		Capabilities: SourceCapabilities{
+			Hashes:   []string{"quickxorhash"},
+			Redirect: true,
+		},
+		New: func() CacheSource { return &OneDriveSource{personal: true} },
+	})
+}
+
 func (p *OneDriveSource) Restore(context *CacheSourceContext) error {
-	var sourceContext OneDriveContext
-	mapstructure.Decode(context.Context, &sourceContext)
-	context.Context = &sourceContext
-	p.Context = &sourceContext
+	sourceContext, err := DecodeContext[OneDriveContext](context)
+	if err != nil {
+		return err
+	}
+	p.Context = sourceContext
 
-	if len(p.Context.ClientId) == 0 || len(p.Context.ClientSecret) == 0 || len(p.Context.User) == 0 {
+	if p.Context.UrlCacheTtlSec == 0 {
+		p.Context.UrlCacheTtlSec = defaultOneDriveUrlCacheTtlSec
+	}
+	p.urls = NewUrlCache(time.Duration(p.Context.UrlCacheTtlSec) * time.Second)
+	if p.cloud, err = msgraphapi.LookupCloud(p.Context.Cloud); err != nil {
+		return err
+	}
+	if len(p.Context.LoginEndpoint) != 0 {
+		p.cloud.LoginEndpoint = p.Context.LoginEndpoint
+	}
+	if len(p.Context.GraphEndpoint) != 0 {
+		p.cloud.GraphEndpoint = p.Context.GraphEndpoint
+	}
+	if p.personal {
+		if len(p.Context.ClientId) == 0 {
+			return errors.New("InvalidContext")
+		}
+		if len(p.Context.TenantId) == 0 {
+			p.Context.TenantId = "consumers"
+		}
+		if len(p.Context.RefreshToken) == 0 {
+			// The source is restored again once the device code login
+			// succeeds.
+			p.startDeviceCodeLogin(context)
+			return errors.New("EmptyRefreshToken")
+		}
+		return rotateToken(p.Context, func() error {
+			return p.InitPersonal(p.Context.RefreshToken)
+		})
+	}
+	hasDrive := len(p.Context.User) != 0 || len(p.Context.SiteId) != 0 ||
+		len(p.Context.SiteUrl) != 0 || len(p.Context.DriveId) != 0
+	hasCredential := len(p.Context.ClientSecret) != 0 || len(p.Context.CertificatePath) != 0
+	if len(p.Context.ClientId) == 0 || !hasCredential || !hasDrive {
 		return errors.New("InvalidContext")
 	}
+	if len(p.Context.CertificatePath) != 0 {
+		if p.certificate, err = msgraphapi.LoadClientCertificate(
+			p.Context.CertificatePath,
+			p.Context.CertificatePassword,
+			p.Context.CertificateThumbprint); err != nil {
+			return err
+		}
+	}
 	if err := p.Init(
 		p.Context.ClientId,
 		p.Context.ClientSecret,
-		"https://graph.microsoft.com/.default",
+		p.scope(),
 		p.Context.TenantId); err != nil {
 		return err
 	}
@@ -47,57 +147,233 @@ func (p *OneDriveSource) Restore(context *CacheSourceContext) error {
 }
 
 func (p *OneDriveSource) Init(clientId string, clientSecret string, scope string, tenantId string) error {
-	if p.mapping == nil {
-		p.mapping = make(map[string]*CacheItem)
+	p.Client = msgraphapi.NewMSGraphClientForCloud(p.cloud)
+	if err := p.acquireToken(clientId, clientSecret, scope, tenantId); err != nil {
+		return err
 	}
-	p.Client = msgraphapi.NewMSGraphClient("https://graph.microsoft.com/v1.0")
-	_, err := p.Client.GetToken(clientId, clientSecret, scope, tenantId)
-	if err != nil {
+	if err := p.selectDrive(); err != nil {
 		return err
 	}
+	p.Context.LastRefreshTime = time.Now()
+	logrus.WithFields(logrus.Fields{
+		"expiresAt": p.Client.TokenExpiry(),
+	}).Info("OneDriveSourceInitialized")
+	return nil
+}
+
+// selectDrive points the client at the configured drive. An explicit drive
+// id wins, then the document library of a SharePoint site, and last the
+// OneDrive of User.
+func (p *OneDriveSource) selectDrive() error {
+	if len(p.Context.DriveId) == 0 && (len(p.Context.SiteId) != 0 || len(p.Context.SiteUrl) != 0) {
+		if len(p.Context.SiteId) == 0 {
+			site, err := p.Client.GetSiteByUrl(p.Context.SiteUrl)
+			if err != nil {
+				return err
+			}
+			p.Context.SiteId = site.Id
+		}
+		drive, err := p.Client.GetSiteDrive(p.Context.SiteId, p.Context.DriveName)
+		if err != nil {
+			return err
+		}
+		p.Context.DriveId = drive.Id
+		logrus.WithFields(logrus.Fields{
+			"siteId":    p.Context.SiteId,
+			"driveId":   drive.Id,
+			"driveName": drive.Name,
+		}).Info("OneDriveSiteDriveResolved")
+	}
+	if len(p.Context.DriveId) != 0 {
+		p.Client.SetDrivePath(fmt.Sprintf("/drives/%s", p.Context.DriveId))
+		return nil
+	}
 	user, err := p.Client.GetUser(p.Context.User)
 	if err != nil {
 		return err
 	}
 	p.Client.SetDefaultUserId(user.Id)
+	return nil
+}
+
+// InitPersonal signs in a consumer account with a refresh token.
+func (p *OneDriveSource) InitPersonal(refreshToken string) error {
+	if len(refreshToken) == 0 {
+		return errors.New("EmptyRefreshToken")
+	}
+	p.Client = msgraphapi.NewMSGraphClientForCloud(p.cloud)
+	if err := p.updateToken(refreshToken); err != nil {
+		return err
+	}
+	p.Client.SetDrivePath("/me/drive")
 	p.Context.LastRefreshTime = time.Now()
 	logrus.WithFields(logrus.Fields{
-		"accessToken": p.Client.Token,
-	}).Info("OneDriveSourceInitialized")
+		"expiresAt": p.Client.TokenExpiry(),
+	}).Info("OneDrivePersonalSourceInitialized")
 	return nil
 }
 
-func (p *OneDriveSource) MappingFile(reqFileUrl string, localName string, hashes map[string]string) error {
-	for _, item := range p.Context.CachedItems {
-		if !item.IsHashEqual(hashes) {
-			continue
+// startDeviceCodeLogin runs the device code login of the source in the
+// background, unless one is running. The login waits for the user far
+// longer than the token lock may be held, it is never run under it.
+func (p *OneDriveSource) startDeviceCodeLogin(record *CacheSourceContext) {
+	oneDriveLogins.lock.Lock()
+	defer oneDriveLogins.lock.Unlock()
+	if oneDriveLogins.running[record.Name] {
+		return
+	}
+	oneDriveLogins.running[record.Name] = true
+	go func() {
+		err := p.restoreAfterLogin(record)
+		oneDriveLogins.lock.Lock()
+		delete(oneDriveLogins.running, record.Name)
+		oneDriveLogins.lock.Unlock()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"sourceName": record.Name,
+				"err":        err,
+			}).Error("OneDriveDeviceCodeLoginFailed")
 		}
-		p.mapping[reqFileUrl] = &item
-		logrus.WithFields(logrus.Fields{
-			"reqUrl": item.ItemId,
-		}).Info("MappingFile")
-		return nil
+	}()
+}
+
+// restoreAfterLogin waits for the device code login, saves the issued
+// refresh token and restores the source with it.
+func (p *OneDriveSource) restoreAfterLogin(record *CacheSourceContext) error {
+	refreshToken, err := p.deviceCodeLogin()
+	if err != nil {
+		return err
+	}
+	config.Update(func() {
+		p.Context.RefreshToken = refreshToken
+	})
+	// The token is saved first, restoring takes over the stored tokens.
+	if err := saveRecord(record); err != nil {
+		return err
 	}
-	return errors.New("CachedFileNotFound")
+	return Manager.Restore(record)
 }
 
-func (p *OneDriveSource) GetUrl(reqFileUrl string) (string, error) {
-	var item *CacheItem
-	if value, ok := p.mapping[reqFileUrl]; ok {
-		item = value
+// deviceCodeLogin starts the device code flow, the user is asked through
+// the log to complete the login in a browser. It returns the issued refresh
+// token.
+func (p *OneDriveSource) deviceCodeLogin() (string, error) {
+	client := msgraphapi.NewMSGraphClientForCloud(p.cloud)
+	code, err := client.RequestDeviceCode(p.Context.ClientId, oneDrivePersonalScope, p.Context.TenantId)
+	if err != nil {
+		return "", err
+	}
+	logrus.WithFields(logrus.Fields{
+		"verificationUri": code.VerificationUri,
+		"userCode":        code.UserCode,
+		"expiresIn":       code.ExpiresIn,
+	}).Warn("OneDriveDeviceCodeLoginRequired")
+	token, err := client.PollDeviceCodeToken(p.Context.ClientId, p.Context.TenantId, code)
+	if err != nil {
+		return "", err
+	}
+	logrus.Info("OneDriveDeviceCodeLoginSucceeded")
+	return token.RefreshToken, nil
+}
+
+func (p *OneDriveSource) updateToken(refreshToken string) error {
+	token, err := p.Client.GetTokenByRefreshToken(p.Context.ClientId, refreshToken, oneDrivePersonalScope, p.Context.TenantId)
+	if err != nil {
+		return err
+	}
+	config.Update(func() {
+		if len(token.RefreshToken) != 0 {
+			p.Context.RefreshToken = token.RefreshToken
+		}
+		p.Context.LastRefreshTime = time.Now()
+	})
+	logrus.WithFields(logrus.Fields{
+		"expiresAt": p.Client.TokenExpiry(),
+	}).Info("OneDriveTokenUpdated")
+	return nil
+}
+
+func (p *OneDriveSource) acquireToken(clientId string, clientSecret string, scope string, tenantId string) error {
+	var err error
+	if p.certificate != nil {
+		_, err = p.Client.GetTokenWithCertificate(clientId, p.certificate, scope, tenantId)
 	} else {
-		return "", errors.New("MappingFileNotFound")
+		_, err = p.Client.GetToken(clientId, clientSecret, scope, tenantId)
+	}
+	return err
+}
+
+func (p *OneDriveSource) TokenExpiry() time.Time {
+	return p.Client.TokenExpiry()
+}
+
+// RefreshToken renews the access token without resolving the drive again
+// and saves the context. Business accounts acquire a new token with their
+// client secret or certificate instead.
+func (p *OneDriveSource) RefreshToken() error {
+	_, err := p.tokenCalls.Do("", func() (struct{}, error) {
+		return struct{}{}, rotateToken(p.Context, p.renewToken)
+	})
+	return err
+}
+
+func (p *OneDriveSource) renewToken() error {
+	if p.personal {
+		return p.updateToken(p.Context.RefreshToken)
+	}
+	if err := p.acquireToken(p.Context.ClientId, p.Context.ClientSecret, p.scope(), p.Context.TenantId); err != nil {
+		return err
+	}
+	config.Update(func() {
+		p.Context.LastRefreshTime = time.Now()
+	})
+	return nil
+}
+
+// scope is the client credentials scope, the .default scope of the Graph
+// endpoint of the selected cloud unless configured.
+func (p *OneDriveSource) scope() string {
+	if len(p.Context.Scope) != 0 {
+		return p.Context.Scope
+	}
+	return p.cloud.DefaultScope()
+}
+
+func (p *OneDriveSource) MappingFile(reqFileUrl string, localName string, hashes map[string]string) error {
+	item, err := p.items.Match(reqFileUrl, hashes)
+	if err != nil {
+		return err
 	}
-	f, err := p.Client.GetDriveItemById(item.ItemId)
+	logrus.WithFields(logrus.Fields{
+		"reqUrl": item.ItemId,
+	}).Info("MappingFile")
+	return nil
+}
+
+func (p *OneDriveSource) GetUrl(reqFileUrl string) (string, error) {
+	item, err := p.items.Lookup(reqFileUrl)
+	if err != nil {
+		return "", err
+	}
+	if url, ok := p.urls.Get(item.ItemId); ok {
+		return url, nil
+	}
+	return p.urlCalls.Do(item.ItemId, func() (string, error) {
+		return p.downloadUrl(reqFileUrl, item.ItemId)
+	})
+}
+
+func (p *OneDriveSource) downloadUrl(reqFileUrl string, itemId string) (string, error) {
+	f, err := p.Client.GetDriveItemById(itemId)
 	if err != nil {
 		if err.Code == msgraphapi.InvalidAuthenticationToken {
 			logrus.Info("OneDriveApiTokenExpired")
-			if err := p.Init(p.Context.ClientId, p.Context.ClientSecret, "https://graph.microsoft.com/.default", p.Context.TenantId); err == nil {
-				config.SaveContext()
+			if err := p.RefreshToken(); err == nil {
 				logrus.WithFields(logrus.Fields{
 					"reqUrl": reqFileUrl,
 				}).Info("OneDriveRefreshTokenRetry")
-				if f, err := p.Client.GetDriveItemById(item.ItemId); err == nil {
+				if f, err := p.Client.GetDriveItemById(itemId); err == nil {
+					p.urls.Put(itemId, f.DownloadUrl)
 					return f.DownloadUrl, nil
 				}
 			}
@@ -108,38 +384,22 @@ func (p *OneDriveSource) GetUrl(reqFileUrl string) (string, error) {
 		}).Info("OneDriveGetUrlError")
 		return "", err
 	}
+	p.urls.Put(itemId, f.DownloadUrl)
 	return f.DownloadUrl, nil
 }
 
-func (p *OneDriveSource) RefreshSource() ([]CacheItem, error) {
-	files, err := p.Client.ListFileRecursiveByPath("/")
-	if err != nil {
-		return nil, err
-	}
-	res := []CacheItem{}
-	for _, item := range files {
-		res = append(res, CacheItem{
-			ItemId:     item.Id,
-			Hashes:     map[string]string{"quickxorhash": item.File.Hashes.QuickXorHash},
-			CachedPath: item.ParentReference.Path,
-		})
-	}
-	logrus.WithFields(logrus.Fields{
-		"count": len(res),
-	}).Info("OneDriveRefreshSource")
-	p.Context.CachedItems = res
-	return res, nil
-}
-
 func (p *OneDriveSource) RestoreSource(items *[]CacheItem) {
-	p.Context.CachedItems = *items
+	p.items.Replace(*items)
 }
 
-func (p *OneDriveSource) MappedFileSize() int { return len(p.mapping) }
+func (p *OneDriveSource) MappedFileSize() int { return p.items.MappedLen() }
+
+func (p *OneDriveSource) CachedFileSize() int { return p.items.Len() }
+
+func (p *OneDriveSource) cachedItems() *sourceItems { return &p.items }
 
-func (p *OneDriveSource) CachedFileSize() int { return len(p.Context.CachedItems) }
+func (p *OneDriveSource) cachedUrls() *UrlCache { return p.urls }
 
 func (p *OneDriveSource) HasMapping(reqUrl string) bool {
-	_, ok := p.mapping[reqUrl]
-	return ok
+	return p.items.HasMapping(reqUrl)
 }
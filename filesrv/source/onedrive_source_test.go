@@ -0,0 +1,171 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"xxtuitui.com/filesvr/msgraphapi"
+)
+
+func TestOneDriveDeviceCodeLoginRunsInBackground(t *testing.T) {
+	var lock sync.Mutex
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/devicecode"):
+			fmt.Fprint(w, `{"device_code":"device","user_code":"USER","verification_uri":"https://example.com","expires_in":60,"interval":1}`)
+		case strings.HasSuffix(r.URL.Path, "/token"):
+			lock.Lock()
+			polls++
+			pending := r.FormValue("grant_type") != "refresh_token" && polls == 1
+			lock.Unlock()
+			if pending {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"authorization_pending"}`)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  "access",
+				"refresh_token": "refresh-" + r.FormValue("grant_type"),
+				"expires_in":    3600,
+			})
+		default:
+			fmt.Fprint(w, `{"value":[],"@odata.deltaLink":"delta"}`)
+		}
+	}))
+	defer server.Close()
+	contexts := CacheSourceContextList{{
+		Name: "onedrive-login",
+		Type: "OneDrivePersonal",
+		Context: map[string]interface{}{
+			"clientId":      "client",
+			"loginEndpoint": server.URL,
+			"graphEndpoint": server.URL,
+		},
+	}}
+	useTestContext(t, &contexts)
+
+	start := time.Now()
+	if err := Manager.Restore(&contexts[0]); err == nil || err.Error() != "EmptyRefreshToken" {
+		t.Fatalf("restore without a token: got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("restore waited %v for the login", elapsed)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !Manager.HasSource("onedrive-login") {
+		if time.Now().After(deadline) {
+			t.Fatal("source was not restored after the login")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	s := Manager.GetSource("onedrive-login").(*OneDriveSource)
+	if token := s.Context.RefreshToken; token != "refresh-refresh_token" {
+		t.Errorf("refresh token after login: got %s", token)
+	}
+}
+
+// newOneDriveTestSource serves the Graph responses of pages keyed by path
+// and query, any other request fails the test.
+func newOneDriveTestSource(t *testing.T, personal bool, drivePath string, pages map[string]string) *OneDriveSource {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path
+		if len(r.URL.RawQuery) != 0 {
+			key += "?" + r.URL.RawQuery
+		}
+		page, ok := pages[key]
+		if !ok {
+			t.Errorf("unexpected request %s", key)
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"itemNotFound","message":"not found"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, strings.ReplaceAll(page, "SERVER", server.URL))
+	}))
+	t.Cleanup(server.Close)
+	client := msgraphapi.NewMSGraphClient(server.URL)
+	client.SetDrivePath(drivePath)
+	return &OneDriveSource{
+		Context: &OneDriveContext{Filter: SourceFilter{
+			RootPaths:      []string{"/Movies"},
+			ExcludeFolders: []string{"Extras"},
+		}},
+		Client:   client,
+		personal: personal,
+	}
+}
+
+func refreshedPaths(t *testing.T, s *OneDriveSource) string {
+	items, err := s.RefreshSource(context.Background())
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	var res []string
+	for _, item := range items {
+		res = append(res, item.CachedPath)
+	}
+	sort.Strings(res)
+	return strings.Join(res, " ")
+}
+
+func TestOneDrivePersonalRefreshQueriesTheDeltaOfRootPaths(t *testing.T) {
+	contexts := CacheSourceContextList{}
+	useTestContext(t, &contexts)
+	file := func(id string, name string, parentId string) string {
+		return fmt.Sprintf(`{"id":%q,"name":%q,"file":{"hashes":{"quickXorHash":"%s-hash"}},"parentReference":{"id":%q}}`, id, name, id, parentId)
+	}
+	s := newOneDriveTestSource(t, true, "/me/drive", map[string]string{
+		"/me/drive/root:/Movies": `{"id":"movies","name":"Movies","folder":{}}`,
+		"/me/drive/root:/Movies:/delta": `{"value":[
+			{"id":"movies","name":"Movies","folder":{},"parentReference":{"id":"root"}},
+			{"id":"sci-fi","name":"Sci Fi","folder":{},"parentReference":{"id":"movies"}},
+			{"id":"extras","name":"Extras","folder":{},"parentReference":{"id":"movies"}},
+			` + file("a", "a.mkv", "sci-fi") + `,
+			` + file("x", "x.mkv", "extras") + `
+		],"@odata.deltaLink":"SERVER/me/drive/root:/Movies:/delta?token=2"}`,
+		"/me/drive/root:/Movies:/delta?token=2": `{"value":[
+			` + file("b", "b.mkv", "movies") + `
+		],"@odata.deltaLink":"SERVER/me/drive/root:/Movies:/delta?token=3"}`,
+	})
+
+	if got := refreshedPaths(t, s); got != "/drive/root:/Movies/Sci Fi/a.mkv" {
+		t.Errorf("first refresh: got %s", got)
+	}
+	if got := refreshedPaths(t, s); got != "/drive/root:/Movies/Sci Fi/a.mkv /drive/root:/Movies/b.mkv" {
+		t.Errorf("refresh with the delta link: got %s", got)
+	}
+	if link := s.Context.Roots["/Movies"].DeltaLink; !strings.HasSuffix(link, "token=3") {
+		t.Errorf("delta link of the root path: got %s", link)
+	}
+}
+
+func TestOneDriveBusinessRefreshWalksRootPaths(t *testing.T) {
+	contexts := CacheSourceContextList{}
+	useTestContext(t, &contexts)
+	s := newOneDriveTestSource(t, false, "/drives/biz", map[string]string{
+		"/drives/biz/root:/Movies": `{"id":"movies","name":"Movies","folder":{}}`,
+		"/drives/biz/items/movies/children": `{"value":[
+			{"id":"sci-fi","name":"Sci Fi","folder":{}},
+			{"id":"extras","name":"Extras","folder":{}},
+			{"id":"a","name":"a.mkv","file":{"hashes":{"quickXorHash":"a-hash"}}}
+		]}`,
+		"/drives/biz/items/sci-fi/children": `{"value":[
+			{"id":"b","name":"b.mkv","file":{"hashes":{"quickXorHash":"b-hash"}}}
+		]}`,
+	})
+
+	if got := refreshedPaths(t, s); got != "/drive/root:/Movies/Sci Fi/b.mkv /drive/root:/Movies/a.mkv" {
+		t.Errorf("walked items: got %s", got)
+	}
+}
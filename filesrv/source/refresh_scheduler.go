@@ -0,0 +1,352 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/config"
+	"xxtuitui.com/filesvr/state"
+)
+
+type (
+	// RefreshStatus describes the last refresh of a source, and whether one
+	// is running now. LastRun is when the last refresh started.
+	RefreshStatus struct {
+		Running    bool      `json:"running"`
+		LastRun    time.Time `json:"lastRun"`
+		DurationMs int64     `json:"durationMs"`
+		ItemCount  int       `json:"itemCount"`
+		Error      string    `json:"error,omitempty"`
+		NextRun    time.Time `json:"nextRun"`
+	}
+
+	refreshEntry struct {
+		interval time.Duration
+		due      time.Time
+		running  bool
+	}
+
+	// RefreshScheduler refreshes the registered sources of a manager on
+	// their interval, so files uploaded to a drive become redirectable
+	// without a restart. Every run is delayed by a random jitter, sources
+	// registered together don't refresh all at once.
+	RefreshScheduler struct {
+		lock    sync.Mutex
+		manager *SourcesManager
+		entries map[string]*refreshEntry
+		wake    chan struct{}
+		start   sync.Once
+	}
+)
+
+const (
+	defaultRefreshInterval = 6 * time.Hour
+	// refreshRetryInterval bounds the wait after a failed refresh.
+	refreshRetryInterval = 10 * time.Minute
+	// refreshJitter is the largest delay added to a run, as a fraction of
+	// the interval.
+	refreshJitter           = 0.1
+	refreshMaxCheckInterval = time.Hour
+	refreshMinCheckInterval = time.Second
+)
+
+var Refreshes = NewRefreshScheduler(&Manager)
+
+func NewRefreshScheduler(manager *SourcesManager) *RefreshScheduler {
+	return &RefreshScheduler{
+		manager: manager,
+		entries: make(map[string]*refreshEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// refreshInterval returns the interval the source is refreshed on, zero if
+// scheduled refreshes are turned off.
+func refreshInterval(record *CacheSourceContext) time.Duration {
+	seconds := record.RefreshIntervalSec
+	if seconds == 0 {
+		seconds = config.App.RefreshIntervalSec
+	}
+	if seconds < 0 {
+		return 0
+	}
+	if seconds == 0 {
+		return defaultRefreshInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Register schedules the source every interval, the first run an interval
+// after lastRun, or right away if it never ran.
+func (p *RefreshScheduler) Register(sourceName string, interval time.Duration, lastRun time.Time) {
+	due := time.Now()
+	if !lastRun.IsZero() {
+		due = lastRun.Add(interval)
+	}
+	due = due.Add(jitter(interval))
+	p.lock.Lock()
+	p.entries[sourceName] = &refreshEntry{interval: interval, due: due}
+	p.lock.Unlock()
+	p.manager.scheduled(sourceName, due)
+	p.notify()
+}
+
+func (p *RefreshScheduler) Unregister(sourceName string) {
+	p.lock.Lock()
+	delete(p.entries, sourceName)
+	p.lock.Unlock()
+	p.manager.scheduled(sourceName, time.Time{})
+}
+
+// Start runs the schedule in the background, later calls do nothing.
+func (p *RefreshScheduler) Start() {
+	p.start.Do(func() { go p.run() })
+}
+
+// Trigger refreshes the source in the background now, a scheduled source
+// is then rescheduled an interval later.
+func (p *RefreshScheduler) Trigger(sourceName string) error {
+	if !p.manager.HasSource(sourceName) {
+		return errors.New("SourceNotFound")
+	}
+	if p.manager.RefreshStatus(sourceName).Running {
+		return errors.New("RefreshRunning")
+	}
+	p.lock.Lock()
+	e := p.entries[sourceName]
+	if e != nil {
+		if e.running {
+			p.lock.Unlock()
+			return errors.New("RefreshRunning")
+		}
+		e.running = true
+	}
+	p.lock.Unlock()
+	go p.refresh(sourceName, e)
+	return nil
+}
+
+func (p *RefreshScheduler) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *RefreshScheduler) run() {
+	for {
+		timer := time.NewTimer(p.refreshDue(time.Now()))
+		select {
+		case <-timer.C:
+		case <-p.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// refreshDue starts the refresh of every source that is due and returns how
+// long to sleep until the next one is.
+func (p *RefreshScheduler) refreshDue(now time.Time) time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	next := refreshMaxCheckInterval
+	for name, e := range p.entries {
+		if e.running {
+			continue
+		}
+		if !e.due.After(now) {
+			e.running = true
+			go p.refresh(name, e)
+			continue
+		}
+		if wait := e.due.Sub(now); wait < next {
+			next = wait
+		}
+	}
+	if next < refreshMinCheckInterval {
+		next = refreshMinCheckInterval
+	}
+	return next
+}
+
+// refresh runs the refresh and schedules the next run of e, which is nil
+// for a source that isn't scheduled.
+func (p *RefreshScheduler) refresh(sourceName string, e *refreshEntry) {
+	_, err := p.manager.Refresh(sourceName)
+	if e == nil {
+		return
+	}
+	wait := e.interval
+	if err != nil && wait > refreshRetryInterval {
+		wait = refreshRetryInterval
+	}
+	due := time.Now().Add(wait + jitter(wait))
+	p.lock.Lock()
+	e.running = false
+	e.due = due
+	_, registered := p.entries[sourceName]
+	p.lock.Unlock()
+	if registered {
+		p.manager.scheduled(sourceName, due)
+	}
+	p.notify()
+}
+
+func jitter(interval time.Duration) time.Duration {
+	max := int64(float64(interval) * refreshJitter)
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(max))
+}
+
+// Cancel stops the refresh the source is running, Refresh then returns the
+// error of the cancellation.
+func (p *SourcesManager) Cancel(sourceName string) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if _, ok := p.sources[sourceName]; !ok {
+		return errors.New("SourceNotFound")
+	}
+	cancel, ok := p.running[sourceName]
+	if !ok {
+		return errors.New("RefreshNotRunning")
+	}
+	cancel()
+	return nil
+}
+
+// RefreshStatus returns the status of the source, the zero status if it
+// never refreshed.
+func (p *SourcesManager) RefreshStatus(sourceName string) RefreshStatus {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if status, ok := p.status[sourceName]; ok {
+		return *status
+	}
+	return RefreshStatus{}
+}
+
+// RefreshStatuses returns the status of every source by name.
+func (p *SourcesManager) RefreshStatuses() map[string]RefreshStatus {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	res := make(map[string]RefreshStatus, len(p.sources))
+	for name := range p.sources {
+		res[name] = RefreshStatus{}
+		if status, ok := p.status[name]; ok {
+			res[name] = *status
+		}
+	}
+	return res
+}
+
+// statusOf returns the status of the source to update, the lock must be
+// held.
+func (p *SourcesManager) statusOf(sourceName string) *RefreshStatus {
+	status, ok := p.status[sourceName]
+	if !ok {
+		status = &RefreshStatus{}
+		p.status[sourceName] = status
+	}
+	return status
+}
+
+func (p *SourcesManager) begin(sourceName string, cancel context.CancelFunc) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.running[sourceName] = cancel
+	p.statusOf(sourceName).Running = true
+}
+
+// finish records the outcome of a refresh that started at start, and
+// stores it unless the items were only taken over from another replica.
+func (p *SourcesManager) finish(sourceName string, start time.Time, count int, store bool, err error) {
+	p.lock.Lock()
+	delete(p.running, sourceName)
+	status := p.statusOf(sourceName)
+	status.Running = false
+	status.LastRun = start
+	status.DurationMs = time.Since(start).Milliseconds()
+	status.ItemCount = count
+	status.Error = ""
+	if err != nil {
+		status.Error = err.Error()
+	}
+	res := *status
+	p.lock.Unlock()
+
+	fields := logrus.Fields{
+		"sourceName": sourceName,
+		"count":      count,
+		"durationMs": res.DurationMs,
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		logrus.WithFields(fields).Info("RefreshSourceCanceled")
+	case err != nil:
+		fields["err"] = err
+		logrus.WithFields(fields).Error("RefreshSourceFailed")
+	default:
+		logrus.WithFields(fields).Info("SourceRefreshed")
+	}
+	if store && config.State != nil {
+		if err := saveStatus(config.State, sourceName, res); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"sourceName": sourceName,
+				"err":        err,
+			}).Warn("SaveRefreshStatusFailed")
+		}
+	}
+}
+
+func (p *SourcesManager) scheduled(sourceName string, due time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.status != nil {
+		p.statusOf(sourceName).NextRun = due
+	}
+}
+
+// restoreStatus loads the stored status of the source, so the schedule
+// carries on from the last refresh before a restart.
+func (p *SourcesManager) restoreStatus(sourceName string) {
+	if config.State == nil {
+		return
+	}
+	content, err := config.State.Get(config.RefreshesBucket, sourceName)
+	if err == state.ErrNotFound {
+		return
+	}
+	var status RefreshStatus
+	if err == nil {
+		err = json.Unmarshal(content, &status)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"sourceName": sourceName,
+			"err":        err,
+		}).Warn("LoadRefreshStatusFailed")
+		return
+	}
+	status.Running = false
+	status.NextRun = time.Time{}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.status[sourceName]; !ok {
+		p.status[sourceName] = &status
+	}
+}
+
+func saveStatus(store state.Store, sourceName string, status RefreshStatus) error {
+	content, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return store.Write(config.RefreshesBucket, map[string][]byte{sourceName: content})
+}
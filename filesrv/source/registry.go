@@ -0,0 +1,147 @@
+package source
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"xxtuitui.com/filesvr/config"
+)
+
+type (
+	// SchemaField describes one key of a source's context as it appears in
+	// the context file.
+	SchemaField struct {
+		Name     string `json:"name"`
+		Type     string `json:"type"`
+		Required bool   `json:"required"`
+	}
+
+	// SourceCapabilities describes what a source type can offer to the web
+	// server.
+	SourceCapabilities struct {
+		// Hashes lists the hash names the source fills into CacheItem.Hashes.
+		Hashes []string `json:"hashes"`
+		// Redirect means the urls returned by GetUrl can be handed to the
+		// client directly.
+		Redirect bool `json:"redirect"`
+		// Relay means the urls returned by GetUrl can be fetched by filesrv
+		// and streamed to the client.
+		Relay bool `json:"relay"`
+	}
+
+	// SourceType is the registration of a backend, keyed by the type name used
+	// in CacheSourceContext.Type.
+	SourceType struct {
+		Name         string             `json:"name"`
+		Schema       []SchemaField      `json:"schema"`
+		Capabilities SourceCapabilities `json:"capabilities"`
+		New          func() CacheSource `json:"-"`
+	}
+)
+
+var (
+	sourceTypesLock sync.RWMutex
+	sourceTypes     = make(map[string]*SourceType)
+)
+
+// RegisterSourceType makes a backend available to SourcesManager.Restore.
+// It is meant to be called from the init function of the package that
+// implements the backend and panics if the type name is taken.
+func RegisterSourceType(t SourceType) {
+	sourceTypesLock.Lock()
+	defer sourceTypesLock.Unlock()
+	if len(t.Name) == 0 || t.New == nil {
+		panic("source: invalid source type registration")
+	}
+	if _, ok := sourceTypes[t.Name]; ok {
+		panic("source: source type " + t.Name + " registered twice")
+	}
+	sourceTypes[t.Name] = &t
+}
+
+func LookupSourceType(name string) (*SourceType, bool) {
+	sourceTypesLock.RLock()
+	defer sourceTypesLock.RUnlock()
+	t, ok := sourceTypes[name]
+	return t, ok
+}
+
+func SourceTypes() []SourceType {
+	sourceTypesLock.RLock()
+	defer sourceTypesLock.RUnlock()
+	res := make([]SourceType, 0, len(sourceTypes))
+	for _, t := range sourceTypes {
+		res = append(res, *t)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// SchemaOf builds the schema of a context struct from its json tags. Fields
+// tagged with `source:"required"` are reported as required.
+func SchemaOf(context interface{}) []SchemaField {
+	t := reflect.TypeOf(context)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var res []SchemaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		res = append(res, SchemaField{
+			Name:     name,
+			Type:     f.Type.String(),
+			Required: f.Tag.Get("source") == "required",
+		})
+	}
+	return res
+}
+
+// DecodeContext converts the raw context loaded from the context file into
+// the typed context of a backend and stores it back, so later saves
+// serialize the typed value.
+func DecodeContext[T any](context *CacheSourceContext) (*T, error) {
+	if typed, ok := context.Context.(*T); ok {
+		return typed, nil
+	}
+	var res T
+	if err := decodeJsonMap(context.Context, &res); err != nil {
+		return nil, err
+	}
+	config.Update(func() {
+		context.Context = &res
+	})
+	return &res, nil
+}
+
+func decodeJsonMap(input interface{}, output interface{}) error {
+	if input == nil {
+		return nil
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName:    "json",
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339),
+		Result:     output,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(input); err != nil {
+		return errors.New("InvalidContext: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package source
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/s3api"
+)
+
+type (
+	S3Context struct {
+		Endpoint        string    `json:"endpoint" source:"required"`
+		Region          string    `json:"region"`
+		Bucket          string    `json:"bucket" source:"required"`
+		PathStyle       bool      `json:"pathStyle"`
+		AccessKeyId     string    `json:"accessKeyId" source:"required"`
+		SecretAccessKey string    `json:"secretAccessKey" source:"required"`
+		SessionToken    string    `json:"sessionToken"`
+		Prefix          string    `json:"prefix"`
+		HeadObjects     bool      `json:"headObjects"`
+		UrlExpireSec    int       `json:"urlExpireSec"`
+		LastRefreshTime time.Time `json:"lastRefreshTime"`
+	}
+
+	S3Source struct {
+		Context *S3Context
+		items   sourceItems
+		Client  *s3api.S3Client
+	}
+)
+
+const defaultS3UrlExpireSec = 3600 * 4
+
+func init() {
+	RegisterSourceType(SourceType{
+		Name:   "S3",
+		Schema: SchemaOf(S3Context{}),
+		Capabilities: SourceCapabilities{
+			Hashes:   []string{"sha256", "sha1", "crc32", "md5"},
+			Redirect: true,
+		},
+		New: func() CacheSource { return &S3Source{} },
+	})
+}
+
+func (p *S3Source) Restore(context *CacheSourceContext) error {
+	sourceContext, err := DecodeContext[S3Context](context)
+	if err != nil {
+		return err
+	}
+	p.Context = sourceContext
+
+	if len(p.Context.Endpoint) == 0 || len(p.Context.Bucket) == 0 ||
+		len(p.Context.AccessKeyId) == 0 || len(p.Context.SecretAccessKey) == 0 {
+		return errors.New("InvalidContext")
+	}
+	if len(p.Context.Region) == 0 {
+		p.Context.Region = "us-east-1"
+	}
+	if p.Context.UrlExpireSec <= 0 {
+		p.Context.UrlExpireSec = defaultS3UrlExpireSec
+	}
+	return p.Init()
+}
+
+func (p *S3Source) Init() error {
+	client, err := s3api.NewS3Client(p.Context.Endpoint, p.Context.Region, p.Context.Bucket, p.Context.PathStyle)
+	if err != nil {
+		return err
+	}
+	client.SetCredentials(p.Context.AccessKeyId, p.Context.SecretAccessKey, p.Context.SessionToken)
+	p.Client = client
+	p.Context.LastRefreshTime = time.Now()
+	logrus.WithFields(logrus.Fields{
+		"endpoint": p.Context.Endpoint,
+		"bucket":   p.Context.Bucket,
+	}).Info("S3SourceInitialized")
+	return nil
+}
+
+func (p *S3Source) MappingFile(reqFileUrl string, localName string, hashes map[string]string) error {
+	_, err := p.items.Match(reqFileUrl, hashes)
+	return err
+}
+
+func (p *S3Source) GetUrl(reqFileUrl string) (string, error) {
+	item, err := p.items.Lookup(reqFileUrl)
+	if err != nil {
+		return "", err
+	}
+	return p.Client.PresignGetObject(item.ItemId, time.Duration(p.Context.UrlExpireSec)*time.Second), nil
+}
+
+func (p *S3Source) RefreshSource(ctx context.Context) ([]CacheItem, error) {
+	objects, err := p.Client.ListAllObjects(ctx, p.Context.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	res := []CacheItem{}
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		hashes, err := p.objectHashes(&object)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"key": object.Key,
+				"err": err,
+			}).Warn("S3ReadChecksumFailed")
+			continue
+		}
+		if len(hashes) == 0 {
+			continue
+		}
+		res = append(res, CacheItem{
+			ItemId:     object.Key,
+			Hashes:     hashes,
+			CachedPath: object.Key,
+		})
+	}
+	logrus.WithFields(logrus.Fields{
+		"count": len(res),
+	}).Info("S3RefreshSource")
+	p.items.Replace(res)
+	return res, nil
+}
+
+// objectHashes picks the strongest checksum known for the object. Only one
+// hash is kept, because IsHashEqual requires every hash of an item to match
+// the local file. The checksums take a HEAD request per object, which is
+// only sent for objects uploaded with a checksum algorithm or when
+// HeadObjects is set. Multipart uploads without one have no usable hash.
+func (p *S3Source) objectHashes(object *s3api.Object) (map[string]string, error) {
+	md5Hash := etagMd5(object.ETag)
+	if len(object.ChecksumAlgorithm) != 0 || p.Context.HeadObjects {
+		checksums, err := p.Client.HeadObject(object.Key)
+		if err != nil {
+			return nil, err
+		}
+		if isFullObjectChecksum(checksums.SHA256) {
+			return map[string]string{"sha256": checksums.SHA256}, nil
+		}
+		if isFullObjectChecksum(checksums.SHA1) {
+			return map[string]string{"sha1": checksums.SHA1}, nil
+		}
+		if isFullObjectChecksum(checksums.CRC32) {
+			return map[string]string{"crc32": checksums.CRC32}, nil
+		}
+	}
+	if len(md5Hash) != 0 {
+		return map[string]string{"md5": md5Hash}, nil
+	}
+	return nil, nil
+}
+
+// Checksums of multipart uploads are checksums of the part checksums and end
+// with the part count, they can't be compared with a hash of the whole file.
+func isFullObjectChecksum(checksum string) bool {
+	return len(checksum) != 0 && !strings.Contains(checksum, "-")
+}
+
+// etagMd5 returns the base64 md5 of a single part upload, whose ETag is the
+// hex md5 of the content.
+func etagMd5(etag string) string {
+	etag = strings.Trim(etag, "\"")
+	if len(etag) != 32 {
+		return ""
+	}
+	content, err := hex.DecodeString(etag)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(content)
+}
+
+func (p *S3Source) RestoreSource(items *[]CacheItem) {
+	p.items.Replace(*items)
+}
+
+func (p *S3Source) MappedFileSize() int { return p.items.MappedLen() }
+
+func (p *S3Source) CachedFileSize() int { return p.items.Len() }
+
+func (p *S3Source) cachedItems() *sourceItems { return &p.items }
+
+func (p *S3Source) HasMapping(reqUrl string) bool {
+	return p.items.HasMapping(reqUrl)
+}
@@ -0,0 +1,57 @@
+package source
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"xxtuitui.com/filesvr/s3api"
+)
+
+func TestS3ObjectHashesOnlyHeadWhenAsked(t *testing.T) {
+	var heads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&heads, 1)
+		w.Header().Set("x-amz-checksum-sha256", "c2hhMjU2")
+	}))
+	defer server.Close()
+	client, err := s3api.NewS3Client(server.URL, "us-east-1", "bucket", true)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	client.SetCredentials("key", "secret", "")
+
+	for _, tc := range []struct {
+		name        string
+		object      s3api.Object
+		headObjects bool
+		hashName    string
+		heads       int32
+	}{
+		{"single part", s3api.Object{ETag: `"9e107d9d372bb6826bd81d3542a419d6"`}, false, "md5", 0},
+		{"multipart", s3api.Object{ETag: `"9e107d9d372bb6826bd81d3542a419d6-12"`}, false, "", 0},
+		{"multipart with checksum", s3api.Object{ETag: `"9e107d9d372bb6826bd81d3542a419d6-12"`, ChecksumAlgorithm: []string{"SHA256"}}, false, "sha256", 1},
+		{"multipart with head objects", s3api.Object{ETag: `"9e107d9d372bb6826bd81d3542a419d6-12"`}, true, "sha256", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&heads, 0)
+			s := &S3Source{Context: &S3Context{HeadObjects: tc.headObjects}, Client: client}
+			tc.object.Key = "movies/a.mkv"
+			hashes, err := s.objectHashes(&tc.object)
+			if err != nil {
+				t.Fatalf("hashes: %v", err)
+			}
+			hashName := ""
+			for name := range hashes {
+				hashName = name
+			}
+			if hashName != tc.hashName {
+				t.Errorf("got hashes %v, want %q", hashes, tc.hashName)
+			}
+			if got := atomic.LoadInt32(&heads); got != tc.heads {
+				t.Errorf("sent %d HEAD requests, want %d", got, tc.heads)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package source
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/config"
+	"xxtuitui.com/filesvr/state"
+)
+
+// Election keeps the leadership of this replica among the replicas sharing
+// a state store. Only the leader runs RefreshSource, the others take over
+// the items it stores.
+type Election struct {
+	store   state.Shared
+	id      string
+	leading int32
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+const (
+	leaderName          = "refresh"
+	leaderTtl           = 30 * time.Second
+	leaderRenewInterval = 10 * time.Second
+
+	// tokenLockTtl bounds how long a replica may take to rotate a token,
+	// and how long the others wait for it.
+	tokenLockTtl    = time.Minute
+	tokenLockPrefix = "token:"
+)
+
+// Leader is the election of the running server, nil unless the state store
+// is shared.
+var Leader *Election
+
+// tokenKeys are the keys of a source context that hold tokens. On a shared
+// store they are rotated while holding the token lock of the source, and
+// taken over from the store before, see rotateToken.
+var tokenKeys = []string{"refreshToken", "authorizationCode"}
+
+func NewElection(store state.Shared, id string) *Election {
+	return &Election{
+		store: store,
+		id:    id,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start campaigns once, so the outcome is known when it returns, and keeps
+// campaigning in the background until Stop.
+func (p *Election) Start() {
+	p.campaign()
+	go p.run()
+}
+
+// Stop resigns the leadership, another replica takes it over at once.
+func (p *Election) Stop() {
+	close(p.stop)
+	<-p.done
+	if err := p.store.Resign(leaderName, p.id); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"replicaId": p.id,
+			"err":       err,
+		}).Warn("ResignLeadershipFailed")
+	}
+	atomic.StoreInt32(&p.leading, 0)
+}
+
+func (p *Election) Leading() bool {
+	return atomic.LoadInt32(&p.leading) == 1
+}
+
+func (p *Election) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(leaderRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.campaign()
+		}
+	}
+}
+
+// campaign takes or renews the leadership. A replica that can't reach the
+// store stops leading, its leadership expires meanwhile.
+func (p *Election) campaign() {
+	leading, err := p.store.Campaign(leaderName, p.id, leaderTtl)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"replicaId": p.id,
+			"err":       err,
+		}).Warn("CampaignFailed")
+	}
+	var value int32
+	if leading {
+		value = 1
+	}
+	if atomic.SwapInt32(&p.leading, value) != value {
+		logrus.WithFields(logrus.Fields{
+			"replicaId": p.id,
+			"leading":   leading,
+		}).Info("LeadershipChanged")
+	}
+}
+
+// isLeader reports whether this replica refreshes the sources, every
+// replica does unless the state store is shared.
+func isLeader() bool {
+	return Leader == nil || Leader.Leading()
+}
+
+// ReplicaId names this replica in the shared state, the host name and a
+// random suffix that tells restarts apart.
+func ReplicaId() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "filesrv"
+	}
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return host + "-" + hex.EncodeToString(buf)
+}
+
+// rotateToken runs renew and saves the context of the source. On a shared
+// store renew runs while holding the token lock of the source and after the
+// tokens another replica rotated were taken over, so two replicas never
+// renew with the same refresh token.
+func rotateToken(sourceContext interface{}, renew func() error) error {
+	record := sourceRecord(sourceContext)
+	shared, ok := config.State.(state.Shared)
+	if record == nil || !ok {
+		if err := renew(); err != nil {
+			return err
+		}
+		saveSourceContext(sourceContext)
+		return nil
+	}
+	return syncSharedContext(shared, record, renew)
+}
+
+// syncSharedContext takes over the stored tokens of the source, runs renew
+// unless it is nil, and saves the context, all while holding the token lock
+// of the source.
+func syncSharedContext(shared state.Shared, record *CacheSourceContext, renew func() error) error {
+	unlock, err := shared.Lock(tokenLockPrefix+record.Name, tokenLockTtl)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := takeOverTokens(shared, record); err != nil {
+		return err
+	}
+	if renew != nil {
+		if err := renew(); err != nil {
+			return err
+		}
+	}
+	return saveRecord(record)
+}
+
+// saveRecord saves the context of the source. On a shared store only the
+// leader writes the whole record, the other replicas only write the tokens
+// into the stored one, their refresh state is older than the leader's.
+func saveRecord(record *CacheSourceContext) error {
+	shared, ok := config.State.(state.Shared)
+	if !ok || isLeader() {
+		return config.SaveSource(record.Name, record)
+	}
+	content, err := shared.Get(config.SourcesBucket, record.Name)
+	if err == state.ErrNotFound {
+		return config.SaveSource(record.Name, record)
+	}
+	if err != nil {
+		return err
+	}
+	var stored map[string]json.RawMessage
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return err
+	}
+	var storedContext map[string]json.RawMessage
+	if err := json.Unmarshal(stored["context"], &storedContext); err != nil {
+		return err
+	}
+	var current map[string]json.RawMessage
+	config.Update(func() {
+		content, err = json.Marshal(record.Context)
+	})
+	if err == nil {
+		err = json.Unmarshal(content, &current)
+	}
+	if err != nil {
+		return err
+	}
+	for _, key := range tokenKeys {
+		if value, ok := current[key]; ok {
+			storedContext[key] = value
+		}
+	}
+	if stored["context"], err = json.Marshal(storedContext); err != nil {
+		return err
+	}
+	return config.SaveSource(record.Name, stored)
+}
+
+// takeOverTokens copies the stored tokens of the source into its context,
+// they differ from the ones in memory once another replica rotated them.
+func takeOverTokens(shared state.Shared, record *CacheSourceContext) error {
+	content, err := shared.Get(config.SourcesBucket, record.Name)
+	if err == state.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stored struct {
+		Context map[string]json.RawMessage `json:"context"`
+	}
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return err
+	}
+	var taken []string
+	config.Update(func() {
+		taken, err = setTokens(record.Context, stored.Context)
+	})
+	if err != nil {
+		return err
+	}
+	if len(taken) != 0 {
+		logrus.WithFields(logrus.Fields{
+			"sourceName": record.Name,
+			"keys":       taken,
+		}).Info("TokensTakenOver")
+	}
+	return nil
+}
+
+// setTokens sets the fields of a typed context named in tokenKeys to the
+// stored values and returns the keys that changed.
+func setTokens(sourceContext interface{}, stored map[string]json.RawMessage) ([]string, error) {
+	v := reflect.ValueOf(sourceContext)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil, nil
+	}
+	v = v.Elem()
+	var res []string
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		raw, ok := stored[name]
+		if !ok || !isTokenKey(name) {
+			continue
+		}
+		value := reflect.New(v.Field(i).Type())
+		if err := json.Unmarshal(raw, value.Interface()); err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value.Elem().Interface(), v.Field(i).Interface()) {
+			v.Field(i).Set(value.Elem())
+			res = append(res, name)
+		}
+	}
+	return res, nil
+}
+
+func isTokenKey(name string) bool {
+	for _, key := range tokenKeys {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
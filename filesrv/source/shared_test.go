@@ -0,0 +1,234 @@
+package source
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"xxtuitui.com/filesvr/config"
+	"xxtuitui.com/filesvr/state"
+)
+
+// useSharedState makes an in-process Redis server the state store.
+func useSharedState(t *testing.T) *state.RedisStore {
+	server := miniredis.RunT(t)
+	store, err := state.OpenRedisStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("open state store: %v", err)
+	}
+	previous := config.State
+	config.State = store
+	t.Cleanup(func() {
+		config.State = previous
+		store.Close()
+	})
+	return store
+}
+
+// tokenProvider accepts only the last refresh token it handed out, like
+// Aliyunpan does.
+type tokenProvider struct {
+	lock      sync.Mutex
+	valid     string
+	rotations int
+}
+
+func (p *tokenProvider) rotate(used string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if used != p.valid {
+		return "", errors.New("InvalidRefreshToken")
+	}
+	p.rotations++
+	p.valid = fmt.Sprintf("token-%d", p.rotations)
+	return p.valid, nil
+}
+
+func TestSharedTokenRotationNeverReusesTokens(t *testing.T) {
+	store := useSharedState(t)
+	provider := &tokenProvider{valid: "token-0"}
+	replicas := make([]*CacheSourceContext, 2)
+	for i := range replicas {
+		replicas[i] = &CacheSourceContext{
+			Name:    "drive",
+			Type:    "AliyunpanShare",
+			Context: &AliyunpanShareContext{ShareId: "share", RefreshToken: "token-0"},
+		}
+	}
+	if err := config.SaveSource("drive", replicas[0]); err != nil {
+		t.Fatalf("save source: %v", err)
+	}
+
+	const rounds = 10
+	var wg sync.WaitGroup
+	for _, record := range replicas {
+		wg.Add(1)
+		go func(record *CacheSourceContext) {
+			defer wg.Done()
+			sourceContext := record.Context.(*AliyunpanShareContext)
+			for round := 0; round < rounds; round++ {
+				err := syncSharedContext(store, record, func() error {
+					token, err := provider.rotate(sourceContext.RefreshToken)
+					if err != nil {
+						return err
+					}
+					config.Update(func() {
+						sourceContext.RefreshToken = token
+					})
+					return nil
+				})
+				if err != nil {
+					t.Errorf("rotate: %v", err)
+					return
+				}
+			}
+		}(record)
+	}
+	wg.Wait()
+
+	if provider.rotations != len(replicas)*rounds {
+		t.Errorf("got %d rotations, want %d", provider.rotations, len(replicas)*rounds)
+	}
+	stored := &CacheSourceContext{Name: "drive", Context: &AliyunpanShareContext{}}
+	if err := takeOverTokens(store, stored); err != nil {
+		t.Fatalf("take over tokens: %v", err)
+	}
+	if token := stored.Context.(*AliyunpanShareContext).RefreshToken; token != provider.valid {
+		t.Errorf("stored token %s, want %s", token, provider.valid)
+	}
+}
+
+func TestFollowersOnlySaveTheirTokens(t *testing.T) {
+	store := useSharedState(t)
+	leading := NewElection(store, "leader")
+	leading.Start()
+	defer leading.Stop()
+	following := NewElection(store, "follower")
+	following.Start()
+	defer following.Stop()
+	previous := Leader
+	t.Cleanup(func() { Leader = previous })
+
+	Leader = leading
+	if err := saveRecord(&CacheSourceContext{
+		Name:    "drive",
+		Context: &OneDriveContext{RefreshToken: "token-0", Roots: map[string]OneDriveRoot{"/": {DeltaLink: "delta-2"}}},
+	}); err != nil {
+		t.Fatalf("save on the leader: %v", err)
+	}
+	// The follower rotated the token, its delta link is older.
+	Leader = following
+	if err := saveRecord(&CacheSourceContext{
+		Name:    "drive",
+		Context: &OneDriveContext{RefreshToken: "token-1", Roots: map[string]OneDriveRoot{"/": {DeltaLink: "delta-1"}}},
+	}); err != nil {
+		t.Fatalf("save on the follower: %v", err)
+	}
+
+	content, err := store.Get(config.SourcesBucket, "drive")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	stored := &CacheSourceContext{Context: &OneDriveContext{}}
+	if err := json.Unmarshal(content, stored); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got := stored.Context.(*OneDriveContext); got.RefreshToken != "token-1" || got.Roots["/"].DeltaLink != "delta-2" {
+		t.Errorf("stored token %s and delta link %s, want token-1 and delta-2", got.RefreshToken, got.Roots["/"].DeltaLink)
+	}
+}
+
+func TestSharedMappingsAndUrlsReachOtherReplicas(t *testing.T) {
+	store := useSharedState(t)
+	replica := func() *sourceItems {
+		mappings := NewMappingStore(store)
+		t.Cleanup(func() { mappings.Close() })
+		items := &sourceItems{}
+		if err := items.attach("drive", store, mappings); err != nil {
+			t.Fatalf("attach: %v", err)
+		}
+		return items
+	}
+	leader, follower := replica(), replica()
+
+	leader.Replace([]CacheItem{
+		{ItemId: "object-1", Hashes: map[string]string{"md5": testObjectHash(1)}},
+	})
+	reqUrl := "/library/parts/1/file.mkv"
+	if _, err := leader.Match(reqUrl, map[string]string{"md5": testObjectHash(1)}); err != nil {
+		t.Fatalf("match: %v", err)
+	}
+	if !follower.HasMapping(reqUrl) {
+		t.Fatal("mapping of the leader is unknown to the follower")
+	}
+	if item, err := follower.Lookup(reqUrl); err != nil || item.ItemId != "object-1" {
+		t.Fatalf("lookup on the follower: got %v, %v", item, err)
+	}
+	if follower.HasMapping("/library/parts/2/file.mkv") {
+		t.Error("follower has a mapping nobody made")
+	}
+
+	urls := []*UrlCache{NewUrlCache(time.Hour), NewUrlCache(time.Hour)}
+	for _, cache := range urls {
+		cache.share(store, "drive")
+	}
+	urls[0].Put("object-1", "https://example.com/object-1")
+	if url, ok := urls[1].Get("object-1"); !ok || url != "https://example.com/object-1" {
+		t.Errorf("url of the other replica: got %q, %v", url, ok)
+	}
+	urls[1].Remove("object-1")
+	urls[0].Remove("object-1")
+	if _, ok := urls[1].Get("object-1"); ok {
+		t.Error("removed url is still shared")
+	}
+}
+
+func TestOnlyTheLeaderRefreshesSources(t *testing.T) {
+	manager := newTestManager(t, "first")
+	server := miniredis.RunT(t)
+	shared, err := state.OpenRedisStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("open state store: %v", err)
+	}
+	defer shared.Close()
+
+	leading := NewElection(shared, "leader")
+	leading.Start()
+	following := NewElection(shared, "follower")
+	following.Start()
+	defer following.Stop()
+	if !leading.Leading() || following.Leading() {
+		t.Fatalf("leading: got %v and %v, want only the first", leading.Leading(), following.Leading())
+	}
+
+	previous := Leader
+	t.Cleanup(func() { Leader = previous })
+	for _, step := range []struct {
+		election *Election
+		count    int
+	}{
+		// The follower finds no stored items before the leader refreshed.
+		{following, 0},
+		{leading, testObjectCount},
+		{following, testObjectCount},
+	} {
+		Leader = step.election
+		items, err := manager.Refresh("first")
+		if err != nil {
+			t.Fatalf("refresh: %v", err)
+		}
+		if len(items) != step.count {
+			t.Errorf("refresh of %s: got %d items, want %d", step.election.id, len(items), step.count)
+		}
+	}
+
+	leading.Stop()
+	following.campaign()
+	if !following.Leading() {
+		t.Error("leadership was not taken over after the leader stopped")
+	}
+}
@@ -0,0 +1,151 @@
+package source
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// SourceFilter limits which part of a drive a source indexes. Paths are
+// slash separated and relative to the drive root, e.g. /Media/Movies.
+// Patterns without a slash are matched against the base name, the others
+// against the whole path, both with the syntax of path.Match.
+type SourceFilter struct {
+	// RootPaths are the folders to index, the whole drive when empty.
+	RootPaths []string `json:"rootPaths"`
+	// Include keeps only files matching one of the patterns.
+	Include []string `json:"include"`
+	// Exclude drops files matching one of the patterns.
+	Exclude []string `json:"exclude"`
+	// Extensions keeps only files with one of the extensions, e.g. mkv.
+	Extensions []string `json:"extensions"`
+	// ExcludeFolders skips folders matching one of the patterns, they are
+	// never listed.
+	ExcludeFolders []string `json:"excludeFolders"`
+	// MinSize drops files smaller than MinSize bytes.
+	MinSize int64 `json:"minSize"`
+}
+
+// Key identifies the filter, a snapshot taken with another filter can't be
+// reused because it lacks what the old filter dropped.
+func (p *SourceFilter) Key() string {
+	filter := *p
+	for _, list := range []*[]string{&filter.RootPaths, &filter.Include, &filter.Exclude, &filter.Extensions, &filter.ExcludeFolders} {
+		if len(*list) == 0 {
+			*list = nil
+		}
+	}
+	content, _ := json.Marshal(&filter)
+	return string(content)
+}
+
+// Roots returns the cleaned root paths without those below another root,
+// the drive root when there is none.
+func (p *SourceFilter) Roots() []string {
+	var res []string
+	for _, root := range p.RootPaths {
+		root = cleanFilterPath(root)
+		covered := false
+		for _, other := range p.RootPaths {
+			other = cleanFilterPath(other)
+			covered = covered || (other != root && isSubPath(root, other))
+		}
+		for _, seen := range res {
+			covered = covered || seen == root
+		}
+		if !covered {
+			res = append(res, root)
+		}
+	}
+	if len(res) == 0 {
+		return []string{"/"}
+	}
+	return res
+}
+
+// WalkFolder reports whether the folder has to be listed, either because it
+// is below a root path or because a root path is below it.
+func (p *SourceFilter) WalkFolder(folderPath string) bool {
+	folderPath = cleanFilterPath(folderPath)
+	if len(p.RootPaths) == 0 {
+		return !p.folderExcluded(folderPath)
+	}
+	for _, root := range p.RootPaths {
+		root = cleanFilterPath(root)
+		if isSubPath(root, folderPath) {
+			return true
+		}
+		if isSubPath(folderPath, root) {
+			return !p.folderExcluded(folderPath)
+		}
+	}
+	return false
+}
+
+// MatchFile reports whether the file belongs to the index.
+func (p *SourceFilter) MatchFile(filePath string, size int64) bool {
+	filePath = cleanFilterPath(filePath)
+	if len(p.RootPaths) != 0 {
+		inRoot := false
+		for _, root := range p.RootPaths {
+			if isSubPath(filePath, cleanFilterPath(root)) {
+				inRoot = true
+				break
+			}
+		}
+		if !inRoot {
+			return false
+		}
+	}
+	for dir := path.Dir(filePath); dir != "/"; dir = path.Dir(dir) {
+		if p.folderExcluded(dir) {
+			return false
+		}
+	}
+	if size < p.MinSize {
+		return false
+	}
+	if len(p.Extensions) != 0 {
+		ext := strings.TrimPrefix(path.Ext(filePath), ".")
+		matched := false
+		for _, e := range p.Extensions {
+			if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(p.Include) != 0 && !matchAnyGlob(p.Include, filePath) {
+		return false
+	}
+	return !matchAnyGlob(p.Exclude, filePath)
+}
+
+func (p *SourceFilter) folderExcluded(folderPath string) bool {
+	return folderPath != "/" && matchAnyGlob(p.ExcludeFolders, folderPath)
+}
+
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		subject := name
+		if !strings.Contains(pattern, "/") {
+			subject = path.Base(name)
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanFilterPath(p string) string {
+	return path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+}
+
+// isSubPath reports whether p is base or below base.
+func isSubPath(p string, base string) bool {
+	return p == base || base == "/" || strings.HasPrefix(p, base+"/")
+}
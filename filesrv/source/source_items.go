@@ -0,0 +1,369 @@
+package source
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/config"
+	"xxtuitui.com/filesvr/state"
+)
+
+// sourceItems holds the cached items of a source and the mappings made from
+// them, it is safe for concurrent use. A stored item slice is never modified,
+// a refresh swaps in a new one, so a snapshot returned by Items stays
+// consistent without holding the lock. Mappings refer to items by id, after
+// a refresh they resolve to the new version of the item and are dropped
+// once the item is gone or its hashes changed. The ids of some sources are
+// paths, a file replaced by another one keeps its id.
+type sourceItems struct {
+	lock     sync.RWMutex
+	items    []CacheItem
+	index    hashIndex
+	ids      map[string]int
+	mapping  map[string]MappingRef
+	store    state.Store
+	mappings *MappingStore
+	name     string
+	// shared is set when other replicas use the store too, they may have
+	// made mappings or stored items this replica hasn't seen.
+	shared bool
+	// saving keeps the items of two replaces stored in order.
+	saving sync.Mutex
+}
+
+// itemSource is implemented by the sources that keep their items in a
+// sourceItems.
+type itemSource interface {
+	cachedItems() *sourceItems
+}
+
+// hashIndex finds items by hash, it maps every hashKey of an item to the
+// positions of the items that have it.
+type hashIndex map[string][]int
+
+// attach loads the stored items and mappings of the source, and stores
+// them from now on when they change. Either store may be nil. Mappings of
+// items that are gone are dropped, unless the source has no items yet and
+// is still to be refreshed.
+func (p *sourceItems) attach(sourceName string, store state.Store, mappings *MappingStore) error {
+	var items []CacheItem
+	if store != nil {
+		var err error
+		if items, err = loadItems(store, sourceName); err != nil {
+			return err
+		}
+	}
+	var refs map[string]MappingRef
+	if mappings != nil {
+		var err error
+		if refs, err = mappings.Load(sourceName); err != nil {
+			return err
+		}
+	}
+
+	index, ids := newHashIndex(items), newIdIndex(items)
+	var stale []string
+	p.lock.Lock()
+	p.items = items
+	p.index = index
+	p.ids = ids
+	if p.mapping == nil {
+		p.mapping = make(map[string]MappingRef)
+	}
+	for reqUrl, ref := range refs {
+		if _, ok := p.ids[ref.key()]; !ok && len(p.items) != 0 {
+			stale = append(stale, reqUrl)
+			continue
+		}
+		p.mapping[reqUrl] = ref
+	}
+	p.store = store
+	p.mappings = mappings
+	p.name = sourceName
+	_, p.shared = store.(state.Shared)
+	p.lock.Unlock()
+
+	if mappings != nil {
+		mappings.Delete(sourceName, stale)
+	}
+	logrus.WithFields(logrus.Fields{
+		"sourceName": sourceName,
+		"items":      len(items),
+		"mappings":   len(refs) - len(stale),
+		"dropped":    len(stale),
+	}).Info("SourceItemsLoaded")
+	return nil
+}
+
+// Items returns the current snapshot, it must not be modified.
+func (p *sourceItems) Items() []CacheItem {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.items
+}
+
+// Replace swaps in the items of a refresh and stores them, the slice must
+// not be modified afterwards.
+func (p *sourceItems) Replace(items []CacheItem) {
+	p.saving.Lock()
+	defer p.saving.Unlock()
+	p.swap(items)
+
+	p.lock.RLock()
+	store, name := p.store, p.name
+	p.lock.RUnlock()
+	if store != nil {
+		if err := saveItems(store, name, items); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"sourceName": name,
+				"err":        err,
+			}).Warn("SaveItemsFailed")
+		}
+	}
+}
+
+// reload takes over the items another replica stored.
+func (p *sourceItems) reload() ([]CacheItem, error) {
+	p.lock.RLock()
+	store, name := p.store, p.name
+	p.lock.RUnlock()
+	if store == nil {
+		return p.Items(), nil
+	}
+	items, err := loadItems(store, name)
+	if err != nil {
+		return nil, err
+	}
+	p.swap(items)
+	return items, nil
+}
+
+// swap indexes the items and drops the mappings of items that are gone or
+// whose hashes changed.
+func (p *sourceItems) swap(items []CacheItem) {
+	index, ids := newHashIndex(items), newIdIndex(items)
+	var stale []string
+	p.lock.Lock()
+	previous, previousIds := p.items, p.ids
+	p.items = items
+	p.index = index
+	p.ids = ids
+	for reqUrl, ref := range p.mapping {
+		i, ok := ids[ref.key()]
+		if ok {
+			j, known := previousIds[ref.key()]
+			ok = !known || sameHashes(previous[j].Hashes, items[i].Hashes)
+		}
+		if !ok {
+			delete(p.mapping, reqUrl)
+			stale = append(stale, reqUrl)
+		}
+	}
+	mappings, name := p.mappings, p.name
+	p.lock.Unlock()
+
+	if mappings != nil && len(stale) != 0 {
+		mappings.Delete(name, stale)
+	}
+}
+
+func loadItems(store state.Store, sourceName string) ([]CacheItem, error) {
+	content, err := store.Get(config.ItemsBucket, sourceName)
+	if err == state.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []CacheItem
+	if err := json.Unmarshal(content, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func saveItems(store state.Store, sourceName string, items []CacheItem) error {
+	content, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return store.Write(config.ItemsBucket, map[string][]byte{sourceName: content})
+}
+
+// Match maps reqFileUrl to the first item whose hashes all match.
+func (p *sourceItems) Match(reqFileUrl string, hashes map[string]string) (*CacheItem, error) {
+	keys := hashKeys(hashes)
+	p.lock.RLock()
+	items, index := p.items, p.index
+	p.lock.RUnlock()
+
+	for _, i := range index.candidates(keys) {
+		if !items[i].matchKeys(keys) {
+			continue
+		}
+		ref := MappingRef{ItemId: items[i].ItemId, DriveId: items[i].DriveId}
+		p.lock.Lock()
+		if p.mapping == nil {
+			p.mapping = make(map[string]MappingRef)
+		}
+		previous, ok := p.mapping[reqFileUrl]
+		p.mapping[reqFileUrl] = ref
+		mappings, name, shared := p.mappings, p.name, p.shared
+		p.lock.Unlock()
+		if mappings != nil && (!ok || previous != ref) {
+			mappings.Put(name, reqFileUrl, ref)
+			// The next request may reach another replica.
+			if shared {
+				if err := mappings.Flush(); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"sourceName": name,
+						"err":        err,
+					}).Warn("SaveMappingsFailed")
+				}
+			}
+		}
+		return &items[i], nil
+	}
+	return nil, errors.New("CachedFileNotFound")
+}
+
+// Lookup returns the item mapped to reqFileUrl, it must not be modified.
+func (p *sourceItems) Lookup(reqFileUrl string) (*CacheItem, error) {
+	item, err := p.lookup(reqFileUrl)
+	if err == nil || !p.isShared() {
+		return item, err
+	}
+	if p.takeOver(reqFileUrl) != nil {
+		return nil, err
+	}
+	return p.lookup(reqFileUrl)
+}
+
+func (p *sourceItems) lookup(reqFileUrl string) (*CacheItem, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	ref, ok := p.mapping[reqFileUrl]
+	if !ok {
+		return nil, errors.New("MappingFileNotFound")
+	}
+	i, ok := p.ids[ref.key()]
+	if !ok {
+		return nil, errors.New("CachedFileNotFound")
+	}
+	return &p.items[i], nil
+}
+
+func (p *sourceItems) HasMapping(reqFileUrl string) bool {
+	p.lock.RLock()
+	_, ok := p.mapping[reqFileUrl]
+	p.lock.RUnlock()
+	if ok || !p.isShared() {
+		return ok
+	}
+	return p.takeOver(reqFileUrl) == nil
+}
+
+func (p *sourceItems) isShared() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.shared && p.mappings != nil
+}
+
+// takeOver loads the mapping another replica made for reqFileUrl, and the
+// items it stored if the mapping refers to an item this replica hasn't
+// seen yet.
+func (p *sourceItems) takeOver(reqFileUrl string) error {
+	p.lock.RLock()
+	mappings, name := p.mappings, p.name
+	p.lock.RUnlock()
+	ref, err := mappings.Get(name, reqFileUrl)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	_, known := p.ids[ref.key()]
+	p.mapping[reqFileUrl] = ref
+	p.lock.Unlock()
+	if !known {
+		if _, err := p.reload(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *sourceItems) Len() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.items)
+}
+
+func (p *sourceItems) MappedLen() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.mapping)
+}
+
+// key identifies the item within its source, ids of Aliyunpan files are
+// only unique within a drive.
+func (p MappingRef) key() string {
+	return p.DriveId + "/" + p.ItemId
+}
+
+// sameHashes reports whether both sets hold the same digests, compared in
+// their normalized form.
+func sameHashes(a map[string]string, b map[string]string) bool {
+	keys := hashKeys(a)
+	if len(keys) != len(hashKeys(b)) {
+		return false
+	}
+	for k, v := range b {
+		if !keys[hashKey(k, v)] {
+			return false
+		}
+	}
+	return true
+}
+
+func newIdIndex(items []CacheItem) map[string]int {
+	res := make(map[string]int, len(items))
+	for i := range items {
+		key := MappingRef{ItemId: items[i].ItemId, DriveId: items[i].DriveId}.key()
+		if _, ok := res[key]; !ok {
+			res[key] = i
+		}
+	}
+	return res
+}
+
+func newHashIndex(items []CacheItem) hashIndex {
+	res := make(hashIndex, len(items))
+	for i := range items {
+		for k, v := range items[i].Hashes {
+			key := hashKey(k, v)
+			res[key] = append(res[key], i)
+		}
+	}
+	return res
+}
+
+// candidates returns the positions of the items sharing at least one hash
+// with keys, in item order. An item matches only if all of its hashes are
+// among keys, so any other item can be skipped.
+func (p hashIndex) candidates(keys map[string]bool) []int {
+	seen := make(map[int]bool)
+	var res []int
+	for key := range keys {
+		for _, i := range p[key] {
+			if !seen[i] {
+				seen[i] = true
+				res = append(res, i)
+			}
+		}
+	}
+	sort.Ints(res)
+	return res
+}
@@ -0,0 +1,137 @@
+package source
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// TokenSource is implemented by sources whose access tokens expire.
+	TokenSource interface {
+		// TokenExpiry returns when the current access token stops being
+		// accepted, the zero time if it is unknown.
+		TokenExpiry() time.Time
+		// RefreshToken renews the access token, stores rotated refresh
+		// tokens in the source context and saves it. Concurrent callers
+		// share one renewal, sources run it through a flightGroup.
+		RefreshToken() error
+	}
+
+	tokenEntry struct {
+		source  TokenSource
+		retryAt time.Time
+	}
+
+	// TokenManager renews the tokens of registered sources shortly before
+	// they expire, so user requests rarely run into an expired token.
+	TokenManager struct {
+		lock    sync.Mutex
+		entries map[string]*tokenEntry
+		margin  time.Duration
+		wake    chan struct{}
+		start   sync.Once
+	}
+)
+
+const (
+	tokenRefreshMargin    = 5 * time.Minute
+	tokenRetryInterval    = time.Minute
+	tokenMaxCheckInterval = 30 * time.Minute
+	tokenMinCheckInterval = time.Second
+)
+
+var Tokens = NewTokenManager(tokenRefreshMargin)
+
+func NewTokenManager(margin time.Duration) *TokenManager {
+	return &TokenManager{
+		entries: make(map[string]*tokenEntry),
+		margin:  margin,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (p *TokenManager) Register(sourceName string, s TokenSource) {
+	p.lock.Lock()
+	p.entries[sourceName] = &tokenEntry{source: s}
+	p.lock.Unlock()
+	p.notify()
+}
+
+func (p *TokenManager) Unregister(sourceName string) {
+	p.lock.Lock()
+	delete(p.entries, sourceName)
+	p.lock.Unlock()
+}
+
+// Start runs the refresh loop in the background, later calls do nothing.
+func (p *TokenManager) Start() {
+	p.start.Do(func() { go p.run() })
+}
+
+func (p *TokenManager) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *TokenManager) run() {
+	for {
+		timer := time.NewTimer(p.refreshDue(time.Now()))
+		select {
+		case <-timer.C:
+		case <-p.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// refreshDue renews every token that expires within the margin and returns
+// how long to sleep until the next one is due.
+func (p *TokenManager) refreshDue(now time.Time) time.Duration {
+	p.lock.Lock()
+	entries := make(map[string]*tokenEntry, len(p.entries))
+	for k, v := range p.entries {
+		entries[k] = v
+	}
+	p.lock.Unlock()
+
+	next := tokenMaxCheckInterval
+	for name, e := range entries {
+		expiry := e.source.TokenExpiry()
+		if expiry.IsZero() {
+			continue
+		}
+		due := expiry.Add(-p.margin)
+		if e.retryAt.After(due) {
+			due = e.retryAt
+		}
+		if !due.After(now) {
+			if err := e.source.RefreshToken(); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"sourceName": name,
+					"expiry":     expiry,
+					"err":        err,
+				}).Error("TokenRefreshFailed")
+				e.retryAt = now.Add(tokenRetryInterval)
+				due = e.retryAt
+			} else {
+				e.retryAt = time.Time{}
+				due = e.source.TokenExpiry().Add(-p.margin)
+				logrus.WithFields(logrus.Fields{
+					"sourceName": name,
+					"expiry":     e.source.TokenExpiry(),
+				}).Info("TokenRefreshed")
+			}
+		}
+		if wait := due.Sub(now); wait < next {
+			next = wait
+		}
+	}
+	if next < tokenMinCheckInterval {
+		next = tokenMinCheckInterval
+	}
+	return next
+}
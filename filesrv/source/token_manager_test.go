@@ -0,0 +1,180 @@
+package source
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTokenServer issues a new access token on every token request and
+// accepts every token it issued, like an identity platform does until they
+// expire.
+type fakeTokenServer struct {
+	lock   sync.Mutex
+	issued map[string]bool
+}
+
+func (p *fakeTokenServer) issue() map[string]interface{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	token := fmt.Sprintf("access-%d", len(p.issued))
+	p.issued[token] = true
+	return map[string]interface{}{
+		"access_token":  token,
+		"refresh_token": "refresh-" + token,
+		"expires_in":    3600,
+	}
+}
+
+func (p *fakeTokenServer) authorized(r *http.Request) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.issued[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+}
+
+func newFakeTokenServer(t *testing.T) (*fakeTokenServer, *httptest.Server) {
+	tokens := &fakeTokenServer{issued: make(map[string]bool)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/token") {
+			json.NewEncoder(w).Encode(tokens.issue())
+			return
+		}
+		if !tokens.authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"code":"InvalidAuthenticationToken","message":"Access token is empty."}}`)
+			return
+		}
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		json.NewEncoder(w).Encode(map[string]string{
+			"id":                           id,
+			"@microsoft.graph.downloadUrl": "https://download.example.com/" + id,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return tokens, server
+}
+
+// renewWhileServing runs the token manager, whose margin is longer than
+// the tokens are valid so every pass renews them, while getUrl is called
+// for count mapped urls until a few renewals happened.
+func renewWhileServing(t *testing.T, name string, s TokenSource, count int, getUrl func(reqUrl string) (string, error)) {
+	tokens := NewTokenManager(2 * time.Hour)
+	tokens.Register(name, s)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for passes := 1; ; passes++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			tokens.refreshDue(time.Now())
+			if passes == 3 {
+				close(renewed)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for {
+				for i := worker; i < count; i += 4 {
+					if _, err := getUrl(fmt.Sprintf("/library/parts/%d/file.mkv", i)); err != nil {
+						t.Errorf("get url %d: %v", i, err)
+						return
+					}
+				}
+				select {
+				case <-renewed:
+					return
+				default:
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	close(done)
+	<-stopped
+}
+
+func mapTestItems(t *testing.T, items *sourceItems, hashName string, count int) {
+	list := make([]CacheItem, count)
+	for i := range list {
+		list[i] = CacheItem{
+			ItemId:     fmt.Sprintf("item-%d", i),
+			Hashes:     map[string]string{hashName: testObjectHash(i)},
+			CachedPath: fmt.Sprintf("/item-%d.mkv", i),
+		}
+	}
+	items.Replace(list)
+	for i := range list {
+		if _, err := items.Match(fmt.Sprintf("/library/parts/%d/file.mkv", i), list[i].Hashes); err != nil {
+			t.Fatalf("mapping %d: %v", i, err)
+		}
+	}
+}
+
+func TestOneDriveTokenRenewalWhileServingUrls(t *testing.T) {
+	_, server := newFakeTokenServer(t)
+	contexts := CacheSourceContextList{{
+		Name: "onedrive",
+		Type: "OneDrivePersonal",
+		Context: map[string]interface{}{
+			"clientId":      "client",
+			"refreshToken":  "refresh-0",
+			"loginEndpoint": server.URL,
+			"graphEndpoint": server.URL,
+		},
+	}}
+	useTestContext(t, &contexts)
+	s := &OneDriveSource{personal: true}
+	if err := s.Restore(&contexts[0]); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	mapTestItems(t, &s.items, "quickxorhash", 200)
+	renewWhileServing(t, "onedrive", s, 200, s.GetUrl)
+}
+
+func TestGoogleDriveTokenRenewalWhileServingUrls(t *testing.T) {
+	tokens, server := newFakeTokenServer(t)
+	contexts := CacheSourceContextList{{
+		Name: "gdrive",
+		Type: "GoogleDrive",
+		Context: map[string]interface{}{
+			"clientId":     "client",
+			"clientSecret": "secret",
+			"refreshToken": "refresh-0",
+			"baseUrl":      server.URL,
+			"tokenUrl":     server.URL + "/token",
+		},
+	}}
+	useTestContext(t, &contexts)
+	s := &GoogleDriveSource{}
+	if err := s.Restore(&contexts[0]); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	mapTestItems(t, &s.items, "md5", 200)
+	renewWhileServing(t, "gdrive", s, 200, func(reqUrl string) (string, error) {
+		dest, err := s.GetUrl(reqUrl)
+		if err != nil {
+			return "", err
+		}
+		req := httptest.NewRequest(http.MethodGet, dest, nil)
+		req.Header = s.RelayHeader()
+		if !tokens.authorized(req) {
+			return "", fmt.Errorf("relay header %v isn't authorized", req.Header)
+		}
+		return dest, nil
+	})
+}
@@ -0,0 +1,236 @@
+package source
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/state"
+)
+
+type (
+	urlCacheEntry struct {
+		url       string
+		createdAt time.Time
+		expiresAt time.Time
+	}
+
+	// UrlCache keeps the download urls handed out by a source, so seeking
+	// through a file doesn't cost an upstream call per range request. An
+	// entry stops being served shortly before the url expires, the next
+	// lookup then fetches a fresh one.
+	UrlCache struct {
+		lock    sync.Mutex
+		entries map[string]urlCacheEntry
+		ttl     time.Duration
+		// shared holds the urls of all replicas in bucket, a url fetched by
+		// one of them is served by the others too.
+		shared state.Shared
+		bucket string
+	}
+
+	// urlSource is implemented by the sources that keep their urls in a
+	// UrlCache.
+	urlSource interface {
+		cachedUrls() *UrlCache
+	}
+
+	// sharedUrl is an entry as kept in a shared store.
+	sharedUrl struct {
+		Url       string    `json:"url"`
+		CreatedAt time.Time `json:"createdAt"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+)
+
+const (
+	// urlCacheMaxMargin is how long before expiry a url stops being served,
+	// a player has to be able to follow the redirect and start reading.
+	urlCacheMaxMargin = 5 * time.Minute
+	// urlCachePurgeSize is the entry count above which expired entries are
+	// dropped on insert.
+	urlCachePurgeSize = 1024
+)
+
+// NewUrlCache creates a cache whose entries live for ttl, or until the url
+// expires when it carries an earlier expiry. A ttl of zero or less disables
+// the cache.
+func NewUrlCache(ttl time.Duration) *UrlCache {
+	return &UrlCache{
+		entries: make(map[string]urlCacheEntry),
+		ttl:     ttl,
+	}
+}
+
+// share makes the cache look up and store urls in the shared store too.
+func (p *UrlCache) share(store state.Shared, sourceName string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.shared = store
+	p.bucket = "urls/" + sourceName
+}
+
+func (p *UrlCache) Get(key string) (string, bool) {
+	now := time.Now()
+	p.lock.Lock()
+	entry, ok := p.entries[key]
+	if ok && !entry.fresh(now) {
+		delete(p.entries, key)
+		ok = false
+	}
+	shared, bucket := p.shared, p.bucket
+	p.lock.Unlock()
+	if ok {
+		return entry.url, true
+	}
+	if shared == nil {
+		return "", false
+	}
+
+	content, err := shared.GetTemp(bucket, key)
+	if err != nil {
+		if err != state.ErrNotFound {
+			logrus.WithFields(logrus.Fields{
+				"key": key,
+				"err": err,
+			}).Warn("GetSharedUrlFailed")
+		}
+		return "", false
+	}
+	var stored sharedUrl
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return "", false
+	}
+	entry = urlCacheEntry{url: stored.Url, createdAt: stored.CreatedAt, expiresAt: stored.ExpiresAt}
+	if !entry.fresh(now) {
+		return "", false
+	}
+	p.lock.Lock()
+	p.entries[key] = entry
+	p.lock.Unlock()
+	return entry.url, true
+}
+
+func (p *UrlCache) Put(key string, rawUrl string) {
+	if p.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	entry := urlCacheEntry{url: rawUrl, createdAt: now, expiresAt: now.Add(p.ttl)}
+	if expiresAt, ok := UrlExpiry(rawUrl); ok && expiresAt.Before(entry.expiresAt) {
+		entry.expiresAt = expiresAt
+	}
+	if !entry.fresh(now) {
+		return
+	}
+	p.lock.Lock()
+	if len(p.entries) >= urlCachePurgeSize {
+		for k, v := range p.entries {
+			if !v.fresh(now) {
+				delete(p.entries, k)
+			}
+		}
+	}
+	p.entries[key] = entry
+	shared, bucket := p.shared, p.bucket
+	p.lock.Unlock()
+	if shared == nil {
+		return
+	}
+
+	content, err := json.Marshal(sharedUrl{Url: entry.url, CreatedAt: entry.createdAt, ExpiresAt: entry.expiresAt})
+	if err == nil {
+		err = shared.SetTemp(bucket, key, content, entry.expiresAt.Sub(now))
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"key": key,
+			"err": err,
+		}).Warn("PutSharedUrlFailed")
+	}
+}
+
+func (p *UrlCache) Remove(key string) {
+	p.lock.Lock()
+	delete(p.entries, key)
+	shared, bucket := p.shared, p.bucket
+	p.lock.Unlock()
+	if shared == nil {
+		return
+	}
+	if err := shared.SetTemp(bucket, key, nil, 0); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"key": key,
+			"err": err,
+		}).Warn("RemoveSharedUrlFailed")
+	}
+}
+
+// fresh reports whether the url is still usable for a while, the margin is
+// a quarter of the lifetime of the url, at most urlCacheMaxMargin.
+func (p *urlCacheEntry) fresh(now time.Time) bool {
+	margin := p.expiresAt.Sub(p.createdAt) / 4
+	if margin > urlCacheMaxMargin {
+		margin = urlCacheMaxMargin
+	}
+	return now.Before(p.expiresAt.Add(-margin))
+}
+
+// UrlExpiry reads the expiry embedded in a signed url: x-oss-expires and
+// Expires of Aliyun OSS, X-Amz-Date with X-Amz-Expires of S3, and the exp
+// claim of the tempauth token of SharePoint download urls.
+func UrlExpiry(rawUrl string) (time.Time, bool) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := make(map[string]string)
+	for k, v := range u.Query() {
+		query[strings.ToLower(k)] = v[0]
+	}
+	for _, name := range []string{"x-oss-expires", "expires"} {
+		if v, ok := query[name]; ok {
+			if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.Unix(sec, 0), true
+			}
+		}
+	}
+	if date, ok := query["x-amz-date"]; ok {
+		signedAt, err := time.Parse("20060102T150405Z", date)
+		sec, convErr := strconv.Atoi(query["x-amz-expires"])
+		if err == nil && convErr == nil {
+			return signedAt.Add(time.Duration(sec) * time.Second), true
+		}
+	}
+	if token, ok := query["tempauth"]; ok {
+		return tempauthExpiry(token)
+	}
+	return time.Time{}, false
+}
+
+func tempauthExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(strings.TrimPrefix(token, "v1."), ".")
+	if len(parts) < 2 {
+		return time.Time{}, false
+	}
+	content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp json.Number `json:"exp"`
+	}
+	if err := json.Unmarshal(content, &claims); err != nil {
+		return time.Time{}, false
+	}
+	sec, err := claims.Exp.Int64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
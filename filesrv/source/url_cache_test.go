@@ -0,0 +1,115 @@
+package source
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func tempauthToken(payload string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return "v1." + encode([]byte(`{"typ":"JWT","alg":"none"}`)) + "." + encode([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestUrlExpiry(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		url    string
+		expiry int64
+	}{
+		{"oss", "https://bj29.cn-beijing.data.alicloudccp.com/file?di=bj29&x-oss-access-key-id=key&x-oss-expires=1700003600&x-oss-signature=sig", 1700003600},
+		{"oss expires", "https://bucket.oss-cn-beijing.aliyuncs.com/file?Expires=1700007200&OSSAccessKeyId=key&Signature=sig", 1700007200},
+		{"oss mixed case", "https://example.com/file?X-Oss-Expires=1700003600", 1700003600},
+		{"s3", "https://bucket.s3.amazonaws.com/file?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=key%2F20231114%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Date=20231114T221320Z&X-Amz-Expires=3600&X-Amz-SignedHeaders=host&X-Amz-Signature=sig", 1700003600},
+		{"s3 without expires", "https://bucket.s3.amazonaws.com/file?X-Amz-Date=20231114T221320Z", 0},
+		{"s3 bad date", "https://bucket.s3.amazonaws.com/file?X-Amz-Date=2023-11-14&X-Amz-Expires=3600", 0},
+		{"tempauth", "https://contoso.sharepoint.com/_layouts/15/download.aspx?UniqueId=id&tempauth=" + tempauthToken(`{"aud":"sharepoint","exp":1700003600}`), 1700003600},
+		{"tempauth quoted exp", "https://contoso.sharepoint.com/download.aspx?tempauth=" + tempauthToken(`{"exp":"1700003600"}`), 1700003600},
+		{"tempauth text exp", "https://contoso.sharepoint.com/download.aspx?tempauth=" + tempauthToken(`{"exp":"soon"}`), 0},
+		{"tempauth no exp", "https://contoso.sharepoint.com/download.aspx?tempauth=" + tempauthToken(`{"aud":"sharepoint"}`), 0},
+		{"tempauth not json", "https://contoso.sharepoint.com/download.aspx?tempauth=" + tempauthToken(`not json`), 0},
+		{"tempauth bad base64", "https://contoso.sharepoint.com/download.aspx?tempauth=v1.e30.!!!.sig", 0},
+		{"tempauth one part", "https://contoso.sharepoint.com/download.aspx?tempauth=v1.opaque", 0},
+		{"unsigned", "https://example.com/file.mkv", 0},
+		{"not a url", "://example.com", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expiry, ok := UrlExpiry(tc.url)
+			if tc.expiry == 0 {
+				if ok {
+					t.Errorf("got expiry %v, want none", expiry)
+				}
+				return
+			}
+			if !ok || expiry.Unix() != tc.expiry {
+				t.Errorf("got %v, %v, want %v", expiry, ok, time.Unix(tc.expiry, 0))
+			}
+		})
+	}
+}
+
+func TestUrlCacheEntryFreshness(t *testing.T) {
+	createdAt := time.Now()
+	for _, tc := range []struct {
+		name     string
+		lifetime time.Duration
+		age      time.Duration
+		fresh    bool
+	}{
+		// The margin is a quarter of the lifetime, at most urlCacheMaxMargin.
+		{"short url early", 8 * time.Minute, 5*time.Minute + 59*time.Second, true},
+		{"short url within margin", 8 * time.Minute, 6 * time.Minute, false},
+		{"long url early", 4 * time.Hour, 3*time.Hour + 54*time.Minute, true},
+		{"long url within margin", 4 * time.Hour, 3*time.Hour + 55*time.Minute, false},
+		{"expired", time.Hour, 2 * time.Hour, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entry := urlCacheEntry{createdAt: createdAt, expiresAt: createdAt.Add(tc.lifetime)}
+			if fresh := entry.fresh(createdAt.Add(tc.age)); fresh != tc.fresh {
+				t.Errorf("fresh after %v: got %v, want %v", tc.age, fresh, tc.fresh)
+			}
+		})
+	}
+}
+
+func TestUrlCacheCapsUrlExpiryAtTheTtl(t *testing.T) {
+	cache := NewUrlCache(time.Hour)
+	now := time.Now()
+	longExpiry := now.Add(2 * time.Hour).Unix()
+	shortExpiry := now.Add(30 * time.Minute).Unix()
+	cache.Put("long", fmt.Sprintf("https://example.com/long?x-oss-expires=%d", longExpiry))
+	cache.Put("short", fmt.Sprintf("https://example.com/short?x-oss-expires=%d", shortExpiry))
+	cache.Put("expired", fmt.Sprintf("https://example.com/expired?x-oss-expires=%d", now.Unix()-10))
+	cache.Put("plain", "https://example.com/plain")
+	for _, key := range []string{"long", "short", "plain"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("url %s was not cached", key)
+		}
+	}
+	if _, ok := cache.Get("expired"); ok {
+		t.Error("expired url was served")
+	}
+
+	// A url valid beyond the ttl is dropped at the ttl, an earlier expiry
+	// of the url is kept.
+	long, short := cache.entries["long"], cache.entries["short"]
+	if ttl := long.expiresAt.Sub(long.createdAt); ttl != time.Hour {
+		t.Errorf("url expiring after the ttl: kept for %v, want the ttl", ttl)
+	}
+	if long.fresh(long.createdAt.Add(time.Hour)) {
+		t.Error("url expiring after the ttl is fresh at the ttl")
+	}
+	if short.expiresAt.Unix() != shortExpiry {
+		t.Errorf("url expiring before the ttl: kept until %v, want %v", short.expiresAt, time.Unix(shortExpiry, 0))
+	}
+	if short.fresh(time.Unix(shortExpiry, 0)) {
+		t.Error("url expiring before the ttl is fresh at its own expiry")
+	}
+
+	disabled := NewUrlCache(0)
+	disabled.Put("plain", "https://example.com/plain")
+	if _, ok := disabled.Get("plain"); ok {
+		t.Error("cache with a zero ttl served a url")
+	}
+}
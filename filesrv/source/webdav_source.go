@@ -0,0 +1,260 @@
+package source
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/webdavapi"
+)
+
+type (
+	WebDAVContext struct {
+		Endpoint         string    `json:"endpoint" source:"required"`
+		Username         string    `json:"username"`
+		Password         string    `json:"password"`
+		RootPath         string    `json:"rootPath"`
+		ManifestPath     string    `json:"manifestPath"`
+		ManifestRoot     string    `json:"manifestRoot"`
+		UrlMode          string    `json:"urlMode"`
+		UrlBase          string    `json:"urlBase"`
+		SecureLinkSecret string    `json:"secureLinkSecret"`
+		UrlExpireSec     int       `json:"urlExpireSec"`
+		LastRefreshTime  time.Time `json:"lastRefreshTime"`
+	}
+
+	WebDAVSource struct {
+		Context *WebDAVContext
+		items   sourceItems
+		Client  *webdavapi.WebDAVClient
+		urlBase *url.URL
+	}
+)
+
+const (
+	// WebDAVUrlBasic redirects to the plain url of the file. It is refused
+	// for a server with credentials, they would reach clients and the log.
+	WebDAVUrlBasic = "basic"
+	// WebDAVUrlRelay streams the file through filesrv, the credentials never
+	// leave the server. It is the default.
+	WebDAVUrlRelay = "relay"
+	// WebDAVUrlSecureLink signs the url for the nginx secure_link module with
+	// secure_link_md5 "$secure_link_expires$uri <secret>".
+	WebDAVUrlSecureLink = "secureLink"
+
+	defaultWebDAVUrlExpireSec = 3600 * 4
+)
+
+// webdavHashNames maps the algorithm names of oc:checksums to the names used
+// by filehasher.
+var webdavHashNames = map[string]string{
+	"MD5":    "md5",
+	"SHA1":   "sha1",
+	"SHA256": "sha256",
+}
+
+func init() {
+	RegisterSourceType(SourceType{
+		Name:   "WebDAV",
+		Schema: SchemaOf(WebDAVContext{}),
+		Capabilities: SourceCapabilities{
+			Hashes:   []string{"md5", "sha1", "sha256"},
+			Redirect: true,
+			Relay:    true,
+		},
+		New: func() CacheSource { return &WebDAVSource{} },
+	})
+}
+
+func (p *WebDAVSource) Restore(context *CacheSourceContext) error {
+	sourceContext, err := DecodeContext[WebDAVContext](context)
+	if err != nil {
+		return err
+	}
+	p.Context = sourceContext
+
+	if len(p.Context.Endpoint) == 0 {
+		return errors.New("InvalidContext")
+	}
+	if len(p.Context.UrlMode) == 0 {
+		p.Context.UrlMode = WebDAVUrlRelay
+	}
+	switch p.Context.UrlMode {
+	case WebDAVUrlRelay:
+	case WebDAVUrlBasic:
+		if len(p.Context.Username) != 0 {
+			return errors.New("BasicUrlModeWithCredentials")
+		}
+	case WebDAVUrlSecureLink:
+		if len(p.Context.SecureLinkSecret) == 0 {
+			return errors.New("EmptySecureLinkSecret")
+		}
+	default:
+		return errors.New("UrlModeNotSupported")
+	}
+	if p.Context.UrlExpireSec <= 0 {
+		p.Context.UrlExpireSec = defaultWebDAVUrlExpireSec
+	}
+	return p.Init()
+}
+
+func (p *WebDAVSource) Init() error {
+	client, err := webdavapi.NewWebDAVClient(p.Context.Endpoint, p.Context.Username, p.Context.Password)
+	if err != nil {
+		return err
+	}
+	p.Client = client
+	p.urlBase = client.BaseUrl
+	if len(p.Context.UrlBase) != 0 {
+		if p.urlBase, err = url.Parse(p.Context.UrlBase); err != nil {
+			return err
+		}
+	}
+	p.Context.LastRefreshTime = time.Now()
+	logrus.WithFields(logrus.Fields{
+		"endpoint": p.Context.Endpoint,
+		"urlMode":  p.Context.UrlMode,
+	}).Info("WebDAVSourceInitialized")
+	return nil
+}
+
+func (p *WebDAVSource) MappingFile(reqFileUrl string, localName string, hashes map[string]string) error {
+	_, err := p.items.Match(reqFileUrl, hashes)
+	return err
+}
+
+func (p *WebDAVSource) GetUrl(reqFileUrl string) (string, error) {
+	item, err := p.items.Lookup(reqFileUrl)
+	if err != nil {
+		return "", err
+	}
+	u := webdavapi.JoinUrl(p.urlBase, item.ItemId)
+	u.User = nil
+	switch p.Context.UrlMode {
+	case WebDAVUrlSecureLink:
+		expires := time.Now().Add(time.Duration(p.Context.UrlExpireSec) * time.Second).Unix()
+		sum := md5.Sum([]byte(fmt.Sprintf("%d%s %s", expires, u.Path, p.Context.SecureLinkSecret)))
+		u.RawQuery = url.Values{
+			"md5":     {base64.RawURLEncoding.EncodeToString(sum[:])},
+			"expires": {fmt.Sprintf("%d", expires)},
+		}.Encode()
+	}
+	return u.String(), nil
+}
+
+// RelayHeader carries the credentials of a relayed request, they are never
+// put into the url.
+func (p *WebDAVSource) RelayHeader() http.Header {
+	if p.Context.UrlMode != WebDAVUrlRelay || len(p.Context.Username) == 0 {
+		return nil
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(p.Context.Username + ":" + p.Context.Password))
+	return http.Header{"Authorization": {"Basic " + credentials}}
+}
+
+// PreferRelay reports whether GetUrl results should be streamed through
+// filesrv instead of being handed to the client.
+func (p *WebDAVSource) PreferRelay() bool {
+	return p.Context.UrlMode == WebDAVUrlRelay
+}
+
+func (p *WebDAVSource) RefreshSource(ctx context.Context) ([]CacheItem, error) {
+	manifest, err := p.loadManifest()
+	if err != nil {
+		return nil, err
+	}
+	resources, apiErr := p.Client.ListFileRecursive(ctx, p.Context.RootPath)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	res := []CacheItem{}
+	for _, r := range resources {
+		hashes := make(map[string]string)
+		for name, digest := range r.Checksums {
+			hashName, ok := webdavHashNames[name]
+			if !ok {
+				continue
+			}
+			content, err := hex.DecodeString(digest)
+			if err != nil {
+				continue
+			}
+			hashes[hashName] = base64.StdEncoding.EncodeToString(content)
+		}
+		if len(hashes) == 0 {
+			hashes = manifest[r.Path]
+		}
+		if len(hashes) == 0 {
+			continue
+		}
+		res = append(res, CacheItem{
+			ItemId:     r.Path,
+			Hashes:     hashes,
+			CachedPath: r.Path,
+		})
+	}
+	logrus.WithFields(logrus.Fields{
+		"count": len(res),
+	}).Info("WebDAVRefreshSource")
+	p.items.Replace(res)
+	return res, nil
+}
+
+// loadManifest reads a hash index produced by filehasher from the server.
+// Filenames in the index are made relative to the collection by replacing
+// ManifestRoot, the directory filehasher was run against.
+func (p *WebDAVSource) loadManifest() (map[string]map[string]string, error) {
+	res := make(map[string]map[string]string)
+	if len(p.Context.ManifestPath) == 0 {
+		return res, nil
+	}
+	content, apiErr := p.Client.Get(p.Context.ManifestPath)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	var entries []struct {
+		Filename string            `json:"filename"`
+		Hashes   map[string]string `json:"hashes"`
+	}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	root := strings.TrimSuffix(p.Context.ManifestRoot, "/")
+	for _, e := range entries {
+		filename := strings.ReplaceAll(e.Filename, "\\", "/")
+		if !strings.HasPrefix(filename, root) {
+			continue
+		}
+		hashes := make(map[string]string)
+		for _, name := range webdavHashNames {
+			if v, ok := e.Hashes[name]; ok {
+				hashes[name] = v
+			}
+		}
+		res["/"+strings.TrimPrefix(strings.TrimPrefix(filename, root), "/")] = hashes
+	}
+	return res, nil
+}
+
+func (p *WebDAVSource) RestoreSource(items *[]CacheItem) {
+	p.items.Replace(*items)
+}
+
+func (p *WebDAVSource) MappedFileSize() int { return p.items.MappedLen() }
+
+func (p *WebDAVSource) CachedFileSize() int { return p.items.Len() }
+
+func (p *WebDAVSource) cachedItems() *sourceItems { return &p.items }
+
+func (p *WebDAVSource) HasMapping(reqUrl string) bool {
+	return p.items.HasMapping(reqUrl)
+}
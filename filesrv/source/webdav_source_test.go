@@ -0,0 +1,49 @@
+package source
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWebDAVUrlsNeverCarryCredentials(t *testing.T) {
+	restore := func(context map[string]interface{}) (*WebDAVSource, error) {
+		s := &WebDAVSource{}
+		context["endpoint"] = "https://dav.example.com/files/alice"
+		err := s.Restore(&CacheSourceContext{Name: "dav", Type: "WebDAV", Context: context})
+		return s, err
+	}
+	if _, err := restore(map[string]interface{}{
+		"urlMode":  WebDAVUrlBasic,
+		"username": "alice",
+		"password": "secret",
+	}); err == nil {
+		t.Error("restored a basic url mode that would redirect with credentials")
+	}
+
+	for _, urlMode := range []string{"", WebDAVUrlSecureLink} {
+		s, err := restore(map[string]interface{}{
+			"urlMode":          urlMode,
+			"username":         "alice",
+			"password":         "secret",
+			"secureLinkSecret": "link-secret",
+		})
+		if err != nil {
+			t.Fatalf("restore %q: %v", urlMode, err)
+		}
+		s.items.Replace([]CacheItem{{ItemId: "/movie.mkv", Hashes: map[string]string{"md5": testObjectHash(1)}}})
+		if err := s.MappingFile("/library/parts/1/file.mkv", "", map[string]string{"md5": testObjectHash(1)}); err != nil {
+			t.Fatalf("mapping: %v", err)
+		}
+		dest, err := s.GetUrl("/library/parts/1/file.mkv")
+		if err != nil {
+			t.Fatalf("get url: %v", err)
+		}
+		if strings.Contains(dest, "secret") || strings.Contains(dest, "alice@") {
+			t.Errorf("url of mode %q carries credentials: %s", urlMode, dest)
+		}
+		relayed := s.PreferRelay()
+		if header := s.RelayHeader(); relayed != (header.Get("Authorization") != "") {
+			t.Errorf("mode %q relays %v with header %v", urlMode, relayed, header)
+		}
+	}
+}
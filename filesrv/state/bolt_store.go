@@ -0,0 +1,77 @@
+package state
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore keeps the buckets in a bbolt file, bbolt locks the file while
+// it is open.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(filename string) (*BoltStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (p *BoltStore) Get(bucket string, key string) ([]byte, error) {
+	var res []byte
+	err := p.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+		value := b.Get([]byte(key))
+		if value == nil {
+			return ErrNotFound
+		}
+		res = append([]byte{}, value...)
+		return nil
+	})
+	return res, err
+}
+
+func (p *BoltStore) List(bucket string) (map[string][]byte, error) {
+	res := make(map[string][]byte)
+	err := p.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			res[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (p *BoltStore) Write(bucket string, changes map[string][]byte) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for key, value := range changes {
+			if value == nil {
+				err = b.Delete([]byte(key))
+			} else {
+				err = b.Put([]byte(key), value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *BoltStore) Close() error {
+	return p.db.Close()
+}
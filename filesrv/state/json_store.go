@@ -0,0 +1,197 @@
+package state
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// JsonStore keeps every value in its own file, a bucket is a directory. A
+// file is replaced by writing a temporary file and renaming it, so a crash
+// leaves either the old or the new value. A write of several values is first
+// saved to the journal of the bucket, which is replayed when the store is
+// opened after a crash. The directory is locked while it is open, a second
+// process can't write to it.
+type JsonStore struct {
+	lock sync.Mutex
+	dir  string
+	file *os.File
+}
+
+const (
+	jsonExt     = ".json"
+	jsonTempExt = ".tmp"
+	jsonLock    = ".lock"
+	jsonJournal = ".journal"
+)
+
+func OpenJsonStore(dir string) (*JsonStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, jsonLock), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	store := &JsonStore{dir: dir, file: file}
+	if err := store.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// replay applies the journals a crash left behind, their writes had not
+// been applied completely.
+func (p *JsonStore) replay() error {
+	journals, err := filepath.Glob(filepath.Join(p.dir, "*", jsonJournal))
+	if err != nil {
+		return err
+	}
+	for _, journal := range journals {
+		content, err := os.ReadFile(journal)
+		if err != nil {
+			return err
+		}
+		var changes map[string][]byte
+		if err := json.Unmarshal(content, &changes); err != nil {
+			return err
+		}
+		if err := apply(filepath.Dir(journal), changes); err != nil {
+			return err
+		}
+		if err := os.Remove(journal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *JsonStore) Get(bucket string, key string) ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	content, err := os.ReadFile(p.path(bucket, key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return content, err
+}
+
+func (p *JsonStore) List(bucket string) (map[string][]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	res := make(map[string][]byte)
+	entries, err := os.ReadDir(p.bucketDir(bucket))
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, jsonExt) {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimSuffix(name, jsonExt))
+		if err != nil {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(p.bucketDir(bucket), name))
+		if err != nil {
+			return nil, err
+		}
+		res[key] = content
+	}
+	return res, nil
+}
+
+// Write applies the changes at once. Several changes are saved to the
+// journal of the bucket before they are applied, so a write a crash
+// interrupted is completed when the store is opened again.
+func (p *JsonStore) Write(bucket string, changes map[string][]byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	dir := p.bucketDir(bucket)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if len(changes) < 2 {
+		return apply(dir, changes)
+	}
+	content, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	journal := filepath.Join(dir, jsonJournal)
+	if err := writeFileAtomic(journal, content); err != nil {
+		return err
+	}
+	if err := apply(dir, changes); err != nil {
+		return err
+	}
+	return os.Remove(journal)
+}
+
+// apply replaces the files of the bucket in dir one by one, each of them
+// atomically.
+func apply(dir string, changes map[string][]byte) error {
+	for key, value := range changes {
+		filename := filepath.Join(dir, url.PathEscape(key)+jsonExt)
+		if value == nil {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := writeFileAtomic(filename, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *JsonStore) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.file.Close()
+}
+
+func (p *JsonStore) bucketDir(bucket string) string {
+	return filepath.Join(p.dir, url.PathEscape(bucket))
+}
+
+// path escapes the key, request urls contain slashes.
+func (p *JsonStore) path(bucket string, key string) string {
+	return filepath.Join(p.bucketDir(bucket), url.PathEscape(key)+jsonExt)
+}
+
+func writeFileAtomic(filename string, content []byte) error {
+	temp := filename + jsonTempExt
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, filename)
+}
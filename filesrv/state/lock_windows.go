@@ -0,0 +1,11 @@
+//go:build windows
+
+package state
+
+import "os"
+
+// lockFile does nothing on windows, the store is not protected against a
+// second process there.
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,177 @@
+package state
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore keeps every bucket in a hash of a Redis server, so several
+// replicas can share their state. Temporary values, locks and leaderships
+// are plain keys with an expiry.
+type RedisStore struct {
+	client *redis.Client
+}
+
+const (
+	redisPrefix       = "filesrv:"
+	redisTempPrefix   = redisPrefix + "temp:"
+	redisLockPrefix   = redisPrefix + "lock:"
+	redisLeaderPrefix = redisPrefix + "leader:"
+
+	// redisLockRetry is how often a taken lock is tried again.
+	redisLockRetry = 100 * time.Millisecond
+)
+
+var (
+	// redisRelease deletes a lock or a leadership only if it still belongs
+	// to the caller, it may have expired and been taken by another replica.
+	redisRelease = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+	redisCampaign = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if not current then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+if current == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0`)
+)
+
+// OpenRedisStore connects to the server at rawUrl, redis://host:port/db.
+func OpenRedisStore(rawUrl string) (*RedisStore, error) {
+	options, err := redis.ParseURL(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisStore{client: client}, nil
+}
+
+func (p *RedisStore) Get(bucket string, key string) ([]byte, error) {
+	res, err := p.client.HGet(context.Background(), redisPrefix+bucket, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return res, err
+}
+
+func (p *RedisStore) List(bucket string) (map[string][]byte, error) {
+	values, err := p.client.HGetAll(context.Background(), redisPrefix+bucket).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]byte, len(values))
+	for k, v := range values {
+		res[k] = []byte(v)
+	}
+	return res, nil
+}
+
+// Write applies the changes in a transaction.
+func (p *RedisStore) Write(bucket string, changes map[string][]byte) error {
+	var (
+		values  []interface{}
+		deleted []string
+	)
+	for key, value := range changes {
+		if value == nil {
+			deleted = append(deleted, key)
+			continue
+		}
+		values = append(values, key, value)
+	}
+	ctx := context.Background()
+	_, err := p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(values) != 0 {
+			pipe.HSet(ctx, redisPrefix+bucket, values...)
+		}
+		if len(deleted) != 0 {
+			pipe.HDel(ctx, redisPrefix+bucket, deleted...)
+		}
+		return nil
+	})
+	return err
+}
+
+func (p *RedisStore) GetTemp(bucket string, key string) ([]byte, error) {
+	res, err := p.client.Get(context.Background(), redisTempPrefix+bucket+":"+key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return res, err
+}
+
+func (p *RedisStore) SetTemp(bucket string, key string, value []byte, ttl time.Duration) error {
+	name := redisTempPrefix + bucket + ":" + key
+	if value == nil {
+		return p.client.Del(context.Background(), name).Err()
+	}
+	return p.client.Set(context.Background(), name, value, ttl).Err()
+}
+
+// Lock tries to take the lock until ttl passed, a holder that died frees it
+// by then.
+func (p *RedisStore) Lock(name string, ttl time.Duration) (func(), error) {
+	token, err := redisToken()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	key := redisLockPrefix + name
+	deadline := time.Now().Add(ttl)
+	for {
+		ok, err := p.client.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() {
+				redisRelease.Run(ctx, p.client, []string{key}, token)
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("StateLockTimeout: " + name)
+		}
+		time.Sleep(redisLockRetry)
+	}
+}
+
+func (p *RedisStore) Campaign(name string, id string, ttl time.Duration) (bool, error) {
+	res, err := redisCampaign.Run(context.Background(), p.client,
+		[]string{redisLeaderPrefix + name}, id, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+func (p *RedisStore) Resign(name string, id string) error {
+	return redisRelease.Run(context.Background(), p.client, []string{redisLeaderPrefix + name}, id).Err()
+}
+
+func (p *RedisStore) Close() error {
+	return p.client.Close()
+}
+
+func redisToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
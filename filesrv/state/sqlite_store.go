@@ -0,0 +1,86 @@
+package state
+
+import (
+	"database/sql"
+
+	_ "modernc.org/sqlite"
+)
+
+// SqliteStore keeps the buckets in one table of a SQLite database. The
+// database runs in WAL mode, readers don't wait for a write.
+type SqliteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS state (
+	bucket TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+)`
+
+func OpenSqliteStore(filename string) (*SqliteStore, error) {
+	db, err := sql.Open("sqlite", filename+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer, a single connection avoids busy errors.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SqliteStore{db: db}, nil
+}
+
+func (p *SqliteStore) Get(bucket string, key string) ([]byte, error) {
+	var res []byte
+	err := p.db.QueryRow("SELECT value FROM state WHERE bucket = ? AND key = ?", bucket, key).Scan(&res)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return res, err
+}
+
+func (p *SqliteStore) List(bucket string) (map[string][]byte, error) {
+	rows, err := p.db.Query("SELECT key, value FROM state WHERE bucket = ?", bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string][]byte)
+	for rows.Next() {
+		var (
+			key   string
+			value []byte
+		)
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		res[key] = value
+	}
+	return res, rows.Err()
+}
+
+func (p *SqliteStore) Write(bucket string, changes map[string][]byte) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	for key, value := range changes {
+		if value == nil {
+			_, err = tx.Exec("DELETE FROM state WHERE bucket = ? AND key = ?", bucket, key)
+		} else {
+			_, err = tx.Exec("INSERT OR REPLACE INTO state (bucket, key, value) VALUES (?, ?, ?)", bucket, key, value)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *SqliteStore) Close() error {
+	return p.db.Close()
+}
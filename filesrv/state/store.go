@@ -0,0 +1,92 @@
+package state
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store keeps the state of filesrv as values in named buckets: the settings
+// of the app, the context and the cached items of every source, and the
+// mappings. Values are written one bucket at a time, so a token refresh
+// only writes the context of its source.
+type Store interface {
+	// Get returns ErrNotFound when the key is not in the bucket.
+	Get(bucket string, key string) ([]byte, error)
+	List(bucket string) (map[string][]byte, error)
+	// Write applies the changes to the bucket at once, a nil value deletes
+	// the key.
+	Write(bucket string, changes map[string][]byte) error
+	Close() error
+}
+
+// Shared is implemented by stores that several replicas of filesrv use at
+// once, it adds what the replicas need to coordinate.
+type Shared interface {
+	Store
+	// GetTemp returns ErrNotFound once the value expired.
+	GetTemp(bucket string, key string) ([]byte, error)
+	// SetTemp stores a value that expires after ttl, a nil value deletes
+	// the key.
+	SetTemp(bucket string, key string, value []byte, ttl time.Duration) error
+	// Lock waits until the named lock is taken. It is held until unlock is
+	// called, at most for ttl.
+	Lock(name string, ttl time.Duration) (unlock func(), err error)
+	// Campaign takes or keeps the named leadership for id for ttl and
+	// reports whether id holds it.
+	Campaign(name string, id string, ttl time.Duration) (bool, error)
+	// Resign gives up the leadership if id holds it.
+	Resign(name string, id string) error
+}
+
+// Kinds of store, the value of AppContext.StateStore.
+const (
+	StoreJson   = "json"
+	StoreBolt   = "bbolt"
+	StoreSqlite = "sqlite"
+	StoreRedis  = "redis"
+)
+
+var ErrNotFound = errors.New("StateNotFound")
+
+// Open opens the store of the kind at path, creating it if needed. A json
+// store is a directory, the path of a redis store is the url of the server,
+// the others are a single file.
+func Open(kind string, path string) (Store, error) {
+	var (
+		store Store
+		err   error
+	)
+	switch kind {
+	case StoreJson:
+		store, err = OpenJsonStore(path)
+	case StoreBolt:
+		store, err = OpenBoltStore(path)
+	case StoreSqlite:
+		store, err = OpenSqliteStore(path)
+	case StoreRedis:
+		store, err = OpenRedisStore(path)
+	default:
+		return nil, errors.New("StateStoreNotSupported: " + kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// DefaultPath places the store of the kind next to the context file, a
+// redis store defaults to a local server.
+func DefaultPath(kind string, contextFile string) string {
+	base := strings.TrimSuffix(contextFile, filepath.Ext(contextFile))
+	switch kind {
+	case StoreRedis:
+		return "redis://localhost:6379/0"
+	case StoreBolt:
+		return base + ".db"
+	case StoreSqlite:
+		return base + ".sqlite"
+	}
+	return base + ".state"
+}
@@ -0,0 +1,190 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestStoresKeepValuesAcrossReopen(t *testing.T) {
+	for _, kind := range []string{StoreJson, StoreBolt, StoreSqlite, StoreRedis} {
+		t.Run(kind, func(t *testing.T) {
+			path := DefaultPath(kind, filepath.Join(t.TempDir(), "context.json"))
+			if kind == StoreRedis {
+				path = "redis://" + miniredis.RunT(t).Addr()
+			}
+			store, err := Open(kind, path)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if _, err := store.Get("sources", "missing"); err != ErrNotFound {
+				t.Fatalf("get missing key: got %v, want ErrNotFound", err)
+			}
+			if err := store.Write("sources", map[string][]byte{
+				"first":                []byte(`{"a":1}`),
+				"/library/parts/1.mkv": []byte(`{"b":2}`),
+			}); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if err := store.Write("sources", map[string][]byte{
+				"first":  nil,
+				"second": []byte(`{"c":3}`),
+			}); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			if store, err = Open(kind, path); err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer store.Close()
+			values, err := store.List("sources")
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			if len(values) != 2 || string(values["/library/parts/1.mkv"]) != `{"b":2}` || string(values["second"]) != `{"c":3}` {
+				t.Errorf("list after reopen: got %q", values)
+			}
+			if values, err := store.List("empty"); err != nil || len(values) != 0 {
+				t.Errorf("list of an empty bucket: got %q, %v", values, err)
+			}
+		})
+	}
+}
+
+func TestJsonStoreIsLockedWhileOpen(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("json stores are not locked on windows")
+	}
+	dir := t.TempDir()
+	store, err := OpenJsonStore(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if second, err := OpenJsonStore(dir); err == nil {
+		second.Close()
+		t.Fatal("opened a store that is open elsewhere")
+	}
+	if err := store.Write("app", map[string][]byte{"context": []byte("{}")}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "app", "*"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("files after write: got %v, %v", files, err)
+	}
+	if info, err := os.Stat(files[0]); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("mode of written file: got %v, %v", info, err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if store, err = OpenJsonStore(dir); err != nil {
+		t.Fatalf("reopen after close: %v", err)
+	}
+	store.Close()
+}
+
+func TestJsonStoreReplaysInterruptedWrites(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenJsonStore(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := store.Write("sources", map[string][]byte{"first": []byte(`{"a":1}`)}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	store.Close()
+
+	// A crash after the journal was saved, before the files were replaced.
+	journal := filepath.Join(dir, "sources", jsonJournal)
+	if err := os.WriteFile(journal, []byte(`{"first":null,"second":"eyJiIjoyfQ=="}`), 0600); err != nil {
+		t.Fatalf("write journal: %v", err)
+	}
+	if store, err = OpenJsonStore(dir); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	values, err := store.List("sources")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(values) != 1 || string(values["second"]) != `{"b":2}` {
+		t.Errorf("list after replay: got %q", values)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("journal left after replay: %v", err)
+	}
+}
+
+func TestRedisStoreCoordinatesReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	first, err := OpenRedisStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer first.Close()
+	second, err := OpenRedisStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer second.Close()
+
+	unlock, err := first.Lock("token:drive", time.Minute)
+	if err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	locked := make(chan func())
+	go func() {
+		unlock, err := second.Lock("token:drive", time.Minute)
+		if err != nil {
+			t.Errorf("lock of the second replica: %v", err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("both replicas hold the lock")
+	case <-time.After(3 * redisLockRetry):
+	}
+	unlock()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(time.Second):
+		t.Fatal("lock was not handed over after unlock")
+	}
+
+	if ok, err := first.Campaign("refresh", "first", time.Minute); err != nil || !ok {
+		t.Fatalf("campaign of the first replica: got %v, %v", ok, err)
+	}
+	if ok, err := second.Campaign("refresh", "second", time.Minute); err != nil || ok {
+		t.Fatalf("campaign of the second replica: got %v, %v", ok, err)
+	}
+	server.FastForward(2 * time.Minute)
+	if ok, err := second.Campaign("refresh", "second", time.Minute); err != nil || !ok {
+		t.Fatalf("campaign after the leadership expired: got %v, %v", ok, err)
+	}
+	if err := first.Resign("refresh", "first"); err != nil {
+		t.Fatalf("resign of a replica that isn't leading: %v", err)
+	}
+	if ok, err := second.Campaign("refresh", "second", time.Minute); err != nil || !ok {
+		t.Fatalf("leadership was taken by a resign of another replica: got %v, %v", ok, err)
+	}
+
+	if err := first.SetTemp("urls", "item", []byte("url"), time.Minute); err != nil {
+		t.Fatalf("set temp: %v", err)
+	}
+	if value, err := second.GetTemp("urls", "item"); err != nil || string(value) != "url" {
+		t.Errorf("get temp: got %q, %v", value, err)
+	}
+	server.FastForward(2 * time.Minute)
+	if _, err := second.GetTemp("urls", "item"); err != ErrNotFound {
+		t.Errorf("get expired temp: got %v, want ErrNotFound", err)
+	}
+}
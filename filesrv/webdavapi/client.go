@@ -0,0 +1,77 @@
+package webdavapi
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+type WebDAVClient struct {
+	HttpClient resty.Client
+	BaseUrl    *url.URL
+	Username   string
+	Password   string
+}
+
+// NewWebDAVClient creates a client rooted at the collection baseUrl, such as
+// https://cloud.example.com/remote.php/dav/files/alice.
+func NewWebDAVClient(baseUrl string, username string, password string) (*WebDAVClient, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseUrl, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("InvalidEndpoint: %s", baseUrl)
+	}
+	client := &WebDAVClient{
+		BaseUrl:  u,
+		Username: username,
+		Password: password,
+	}
+	client.HttpClient = *resty.New()
+	if len(username) != 0 {
+		client.HttpClient.SetBasicAuth(username, password)
+	}
+	return client, nil
+}
+
+// ResourceUrl returns the url of path, a slash separated path relative to
+// the base collection.
+func (p *WebDAVClient) ResourceUrl(path string) *url.URL {
+	return JoinUrl(p.BaseUrl, path)
+}
+
+// JoinUrl appends path to the path of base and escapes every segment.
+func JoinUrl(base *url.URL, path string) *url.URL {
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+	u.RawPath = ""
+	return &u
+}
+
+// relativePath converts an href of a multistatus response into a path
+// relative to the base collection.
+func (p *WebDAVClient) relativePath(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	basePath := strings.TrimSuffix(p.BaseUrl.Path, "/")
+	if !strings.HasPrefix(u.Path, basePath) {
+		return "", fmt.Errorf("HrefOutOfCollection: %s", href)
+	}
+	return "/" + strings.Trim(strings.TrimPrefix(u.Path, basePath), "/"), nil
+}
+
+func (p *WebDAVClient) Get(path string) ([]byte, *ApiError) {
+	resp, err := p.HttpClient.R().Get(p.ResourceUrl(path).String())
+	if err != nil {
+		return nil, NewApiError(0, "TransportError", err.Error())
+	}
+	if resp.IsError() {
+		return nil, ParseStatus(resp.StatusCode(), resp.Status())
+	}
+	return resp.Body(), nil
+}
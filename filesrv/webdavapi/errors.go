@@ -0,0 +1,29 @@
+package webdavapi
+
+import "net/http"
+
+type ApiError struct {
+	Code       string
+	Message    string
+	StatusCode int
+}
+
+func (p ApiError) Error() string {
+	return p.Code + ": " + p.Message
+}
+
+func NewApiError(statusCode int, code string, message string) *ApiError {
+	return &ApiError{code, message, statusCode}
+}
+
+func ParseStatus(statusCode int, status string) *ApiError {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return NewApiError(statusCode, "Unauthorized", status)
+	case http.StatusForbidden:
+		return NewApiError(statusCode, "Forbidden", status)
+	case http.StatusNotFound:
+		return NewApiError(statusCode, "NotFound", status)
+	}
+	return NewApiError(statusCode, "UnknownError", status)
+}
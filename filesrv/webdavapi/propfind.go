@@ -0,0 +1,138 @@
+package webdavapi
+
+import (
+	"context"
+	"encoding/xml"
+	"strconv"
+	"strings"
+)
+
+type (
+	Resource struct {
+		Path         string
+		IsCollection bool
+		Size         int64
+		ETag         string
+		LastModified string
+		// Checksums maps upper case algorithm names such as SHA1 or MD5 to
+		// hex digests, as reported by oc:checksums.
+		Checksums map[string]string
+	}
+
+	resourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	}
+
+	prop struct {
+		ResourceType     resourceType `xml:"DAV: resourcetype"`
+		GetContentLength string       `xml:"DAV: getcontentlength"`
+		GetETag          string       `xml:"DAV: getetag"`
+		GetLastModified  string       `xml:"DAV: getlastmodified"`
+		Checksums        []string     `xml:"http://owncloud.org/ns checksums>checksum"`
+	}
+
+	propstat struct {
+		Prop   prop   `xml:"DAV: prop"`
+		Status string `xml:"DAV: status"`
+	}
+
+	response struct {
+		Href     string     `xml:"DAV: href"`
+		Propstat []propstat `xml:"DAV: propstat"`
+	}
+
+	multistatus struct {
+		XMLName   xml.Name   `xml:"DAV: multistatus"`
+		Responses []response `xml:"DAV: response"`
+	}
+)
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getetag/>
+    <d:getlastmodified/>
+    <oc:checksums/>
+  </d:prop>
+</d:propfind>`
+
+// Propfind lists path and, for collections, its direct members.
+func (p *WebDAVClient) Propfind(path string) ([]Resource, *ApiError) {
+	resp, err := p.HttpClient.
+		R().
+		SetHeader("Depth", "1").
+		SetHeader("Content-Type", "application/xml; charset=utf-8").
+		SetBody(propfindBody).
+		Execute("PROPFIND", p.ResourceUrl(path).String())
+	if err != nil {
+		return nil, NewApiError(0, "TransportError", err.Error())
+	}
+	if resp.IsError() {
+		return nil, ParseStatus(resp.StatusCode(), resp.Status())
+	}
+	var ms multistatus
+	if err := xml.Unmarshal(resp.Body(), &ms); err != nil {
+		return nil, NewApiError(resp.StatusCode(), "InvalidResponse", err.Error())
+	}
+
+	var res []Resource
+	for _, r := range ms.Responses {
+		resourcePath, err := p.relativePath(r.Href)
+		if err != nil {
+			return nil, NewApiError(resp.StatusCode(), "InvalidResponse", err.Error())
+		}
+		resource := Resource{Path: resourcePath, Checksums: make(map[string]string)}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			resource.IsCollection = ps.Prop.ResourceType.Collection != nil
+			resource.Size, _ = strconv.ParseInt(ps.Prop.GetContentLength, 10, 64)
+			resource.ETag = strings.Trim(ps.Prop.GetETag, "\"")
+			resource.LastModified = ps.Prop.GetLastModified
+			for _, line := range ps.Prop.Checksums {
+				for _, c := range strings.Fields(line) {
+					name, digest, ok := strings.Cut(c, ":")
+					if !ok {
+						continue
+					}
+					resource.Checksums[strings.ToUpper(name)] = strings.ToLower(digest)
+				}
+			}
+		}
+		res = append(res, resource)
+	}
+	return res, nil
+}
+
+// ListFileRecursive walks the collection at path with one depth 1 PROPFIND
+// per collection, since many servers refuse infinite depth. The walk stops
+// once ctx is canceled.
+func (p *WebDAVClient) ListFileRecursive(ctx context.Context, path string) ([]Resource, *ApiError) {
+	var res []Resource
+	pending := []string{"/" + strings.Trim(path, "/")}
+	for len(pending) != 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, NewApiError(0, "Canceled", err.Error())
+		}
+		current := pending[0]
+		pending = pending[1:]
+		resources, err := p.Propfind(current)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resources {
+			if r.Path == current {
+				continue
+			}
+			if r.IsCollection {
+				pending = append(pending, r.Path)
+				continue
+			}
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,37 @@
+package websvr
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/config"
+)
+
+// adminAuth lets through the requests that carry the admin token of the
+// config as "Authorization: Bearer <token>". The admin endpoints bind
+// sources to accounts, they are refused altogether without a token.
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c.Request, config.App.AdminToken) {
+			logrus.WithFields(logrus.Fields{
+				"client_ip": c.ClientIP(),
+				"req_uri":   c.Request.URL.Path,
+			}).Warn("AdminRequestRefused")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+func isAdmin(r *http.Request, adminToken string) bool {
+	header := r.Header.Get("Authorization")
+	if len(adminToken) == 0 || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
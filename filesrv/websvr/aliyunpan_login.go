@@ -0,0 +1,45 @@
+package websvr
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/source"
+)
+
+const aliyunpanQrCodeSize = 256
+
+// startAliyunpanLogin starts a QR code login for an Aliyunpan source, to
+// onboard it or to replace a refresh token that stopped working.
+func startAliyunpanLogin(c *gin.Context) {
+	sourceName := c.Param("source")
+	if err := source.AliyunpanLogins.Start(sourceName, nil); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"sourceName": sourceName,
+			"err":        err,
+		}).Info("StartAliyunpanLoginFailed")
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	getAliyunpanLogin(c)
+}
+
+func getAliyunpanLogin(c *gin.Context) {
+	state, ok := source.AliyunpanLogins.State(c.Param("source"))
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, state)
+}
+
+func getAliyunpanQrCode(c *gin.Context) {
+	content, err := source.AliyunpanQrCodePng(c.Param("source"), aliyunpanQrCodeSize)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "image/png", content)
+}
@@ -39,7 +39,7 @@ func getCacheUrlHandler(c *gin.Context) {
 		"reqUrl":     reqUrl,
 		"mappingTo":  dest,
 	}).Info("GetMappingUrl")
-	c.Redirect(307, dest)
+	serveMappingUrl(c, sourceName, dest)
 }
 
 func getCacheUrlHandlerByDefault(c *gin.Context) {
@@ -94,5 +94,60 @@ func getCacheUrlHandlerByDefault(c *gin.Context) {
 		"reqUrl":     reqUrl,
 		"mappingTo":  dest,
 	}).Info("GetMappingUrl")
-	c.Redirect(307, dest)
+	serveMappingUrl(c, sourceName, dest)
+}
+
+// relayedHeaders are the client headers sent on to the upstream host when
+// relaying, the others carry Plex tokens, cookies and identifiers.
+var relayedHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "Accept", "Accept-Encoding"}
+
+// serveMappingUrl redirects the client to dest, or streams it through filesrv
+// when the source can only be relayed or asks for it.
+func serveMappingUrl(c *gin.Context, sourceName string, dest string) {
+	t := source.Manager.GetSourceType(sourceName)
+	relay := t != nil && t.Capabilities.Relay && !t.Capabilities.Redirect
+	if r, ok := source.Manager.GetSource(sourceName).(source.RelaySource); ok && r.PreferRelay() {
+		relay = true
+	}
+	if !relay {
+		c.Redirect(307, dest)
+		return
+	}
+	var header http.Header
+	if h, ok := source.Manager.GetSource(sourceName).(source.RelayHeaderSource); ok {
+		header = h.RelayHeader()
+	}
+	remote, err := url.Parse(dest)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"sourceName": sourceName,
+			"mappingTo":  dest,
+			"err":        err,
+		}).Info("ParseMappingUrlFailed")
+		c.Status(http.StatusBadGateway)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(remote)
+	proxy.Director = func(req *http.Request) {
+		req.Header = make(http.Header)
+		for _, k := range relayedHeaders {
+			if v, ok := c.Request.Header[k]; ok {
+				req.Header[k] = append([]string(nil), v...)
+			}
+		}
+		// A nil value keeps the proxy from adding the client address.
+		req.Header["X-Forwarded-For"] = nil
+		req.Host = remote.Host
+		req.URL = &url.URL{
+			Scheme:   remote.Scheme,
+			Host:     remote.Host,
+			Path:     remote.Path,
+			RawPath:  remote.RawPath,
+			RawQuery: remote.RawQuery,
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
 }
@@ -0,0 +1,53 @@
+package websvr
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"xxtuitui.com/filesvr/source"
+)
+
+func getRefreshStatuses(c *gin.Context) {
+	c.JSON(http.StatusOK, source.Manager.RefreshStatuses())
+}
+
+func getRefreshStatus(c *gin.Context) {
+	sourceName := c.Param("source")
+	if !source.Manager.HasSource(sourceName) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, source.Manager.RefreshStatus(sourceName))
+}
+
+// startRefresh refreshes a source now instead of waiting for its schedule,
+// so files just uploaded become redirectable.
+func startRefresh(c *gin.Context) {
+	sourceName := c.Param("source")
+	if err := source.Refreshes.Trigger(sourceName); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"sourceName": sourceName,
+			"err":        err,
+		}).Info("StartRefreshFailed")
+		c.AbortWithError(refreshErrorStatus(err), err)
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+func cancelRefresh(c *gin.Context) {
+	sourceName := c.Param("source")
+	if err := source.Manager.Cancel(sourceName); err != nil {
+		c.AbortWithError(refreshErrorStatus(err), err)
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+func refreshErrorStatus(err error) int {
+	if err.Error() == "SourceNotFound" {
+		return http.StatusNotFound
+	}
+	return http.StatusConflict
+}
@@ -32,6 +32,14 @@ func Run() {
 	r.GET("/library/sections/:id/*proxyPath", proxy)
 	r.GET("/library/metadata/:id/*proxyPath", proxy)
 	r.POST("/cache/mapping", MappingFile)
+	admin := r.Group("/admin", adminAuth())
+	admin.POST("/aliyunpan/login/:source", startAliyunpanLogin)
+	admin.GET("/aliyunpan/login/:source", getAliyunpanLogin)
+	admin.GET("/aliyunpan/login/:source/qrcode.png", getAliyunpanQrCode)
+	admin.GET("/refresh", getRefreshStatuses)
+	admin.GET("/refresh/:source", getRefreshStatus)
+	admin.POST("/refresh/:source", startRefresh)
+	admin.DELETE("/refresh/:source", cancelRefresh)
 	if err := r.Run(fmt.Sprintf(":%d", config.App.Port)); err != nil {
 		fmt.Printf("startup service failed, err: %v\n", err)
 		return